@@ -4,16 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
 	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"syscall"
-	"time"
 
+	"github.com/Dasio/go-stremio/internal/singleflight"
 	"github.com/Dasio/go-stremio/pkg/cinemeta"
 	"github.com/rs/cors"
 )
@@ -33,19 +37,40 @@ type ManifestCallback func(ctx context.Context, manifest *Manifest, userData any
 
 // CatalogHandler is the callback for catalog requests for a specific type (like "movie").
 // The id parameter is the catalog ID that you specified yourself in the CatalogItem objects in the Manifest.
+// The extra parameter contains the extra arguments like the search query, which Stremio sends for the ExtraItems of the CatalogItem.
+// They're already validated against the ExtraItems (required, options and options limit), so for example a required search query is never empty.
 // The userData parameter depends on whether you called `RegisterUserData()` before:
 // If not, a simple string will be passed. It's empty if the user didn't provide user data.
 // If yes, a pointer to an object you registered will be passed. It's nil if the user didn't provide user data.
-type CatalogHandler func(ctx context.Context, id string, userData any) ([]MetaPreviewItem, error)
+// Return ErrNotFound or ErrBadRequest for "404 Not Found" or "400 Bad Request" responses, or a *HandlerError to control the error response.
+type CatalogHandler func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error)
 
 // StreamHandler is the callback for stream requests for a specific type (like "movie").
-// The context parameter contains a meta object under the key "meta" if PutMetaInContext was set to true in the addon options.
+// The context parameter contains the meta of the requested movie or TV show episode if PutMetaInContext was set to true in the addon options.
+// You can get it with MetaFromContext(), or with cinemeta.FromContext() if the meta was fetched with a MetaFetcher like the Cinemeta client.
 // The id parameter can be for example an IMDb ID if your addon handles the "movie" type.
 // The userData parameter depends on whether you called `RegisterUserData()` before:
 // If not, a simple string will be passed. It's empty if the user didn't provide user data.
 // If yes, a pointer to an object you registered will be passed. It's nil if the user didn't provide user data.
+// Return ErrNotFound if you don't have streams for the requested ID, or a *HandlerError to control the error response.
 type StreamHandler func(ctx context.Context, id string, userData any) ([]StreamItem, error)
 
+// MetaHandler is the callback for meta requests for a specific type (like "movie").
+// The id parameter is the ID of a MetaPreviewItem that you returned in a catalog, or for example an IMDb ID if your addon handles the "movie" type.
+// Return ErrNotFound if you don't have meta info for the requested ID, or a *HandlerError to control the error response.
+// The userData parameter depends on whether you called `RegisterUserData()` before:
+// If not, a simple string will be passed. It's empty if the user didn't provide user data.
+// If yes, a pointer to an object you registered will be passed. It's nil if the user didn't provide user data.
+type MetaHandler func(ctx context.Context, id string, userData any) (MetaItem, error)
+
+// AddonCatalogHandler is the callback for addon catalog requests for a specific type (like "all").
+// Addon catalogs are lists of other addons, which Stremio shows in its addons section.
+// The id parameter is the addon catalog ID that you specified yourself in the AddonCatalogs of the Manifest.
+// The userData parameter depends on whether you called `RegisterUserData()` before:
+// If not, a simple string will be passed. It's empty if the user didn't provide user data.
+// If yes, a pointer to an object you registered will be passed. It's nil if the user didn't provide user data.
+type AddonCatalogHandler func(ctx context.Context, id string, userData any) ([]AddonDescriptor, error)
+
 // ConfigurationHandler is the callback for configuration requests.
 // The userData parameter depends on whether you called `RegisterUserData()` before:
 // If not, a simple string will be passed. It's empty if the user didn't provide user data.
@@ -54,6 +79,7 @@ type ConfigurationHandler func(ctx context.Context, userData any) (map[string]an
 
 // MetaFetcher returns metadata for movies and TV shows.
 // It's used when you configure that the media name should be logged or that metadata should be put into the context.
+// For IDs other than IMDb IDs, use a MetaProvider instead. NewCinemetaProvider() turns a MetaFetcher into a MetaProvider.
 type MetaFetcher interface {
 	GetMovie(ctx context.Context, imdbID string) (cinemeta.Meta, error)
 	GetTVShow(ctx context.Context, imdbID string, season int, episode int) (cinemeta.Meta, error)
@@ -70,32 +96,42 @@ type ConfigurationUI struct {
 // Addon represents a remote addon.
 // You can create one with NewAddon() and then run it with Run().
 type Addon struct {
-	manifest         Manifest
-	catalogHandlers  map[string]CatalogHandler
-	streamHandlers   map[string]StreamHandler
-	configHandler    ConfigurationHandler
-	configUI         *ConfigurationUI
-	opts             Options
-	logger           *slog.Logger
-	customEndpoints  []customEndpoint
-	manifestCallback ManifestCallback
-	userDataType     reflect.Type
-	metaClient       MetaFetcher
+	manifest             Manifest
+	catalogHandlers      map[string]CatalogHandler
+	streamHandlers       map[string]StreamHandler
+	metaHandlers         map[string]MetaHandler
+	subtitleHandlers     map[string]SubtitleHandler
+	addonCatalogHandlers map[string]AddonCatalogHandler
+	configHandler        ConfigurationHandler
+	configUI             *ConfigurationUI
+	opts                 Options
+	logger               *slog.Logger
+	customEndpoints      []customEndpoint
+	customMiddlewares    []customMiddleware
+	manifestCallback     ManifestCallback
+	userDataType         reflect.Type
+	metaProvider         MetaProvider
+	// The Cinemeta client that NewAddon created by default, closed when Serve() returns
+	defaultMetaClient *cinemeta.Client
 }
 
 // NewAddon creates a new Addon object that can be started with Run().
-// A proper manifest must be supplied, but manifestCallback and all but one handler can be nil in case you only want to handle specific requests and opts can be the zero value of Options.
+// A proper manifest must be supplied, but manifestCallback and the handlers can be nil in case you only want to handle specific requests and opts can be the zero value of Options.
+// At least one catalog, stream, meta, subtitles or addon catalog handler must be set before running the addon though.
+// Meta, subtitles and addon catalog handlers can be set with SetMetaHandlers(), SetSubtitleHandlers() and SetAddonCatalogHandlers().
 func NewAddon(manifest Manifest, catalogHandlers map[string]CatalogHandler, streamHandlers map[string]StreamHandler, opts Options) (*Addon, error) {
 	// Precondition checks
 	if manifest.ID == "" || manifest.Name == "" || manifest.Description == "" || manifest.Version == "" {
 		return nil, errors.New("an empty manifest was passed")
-	} else if catalogHandlers == nil && streamHandlers == nil {
-		return nil, errors.New("no handlers were passed")
 	} else if (opts.CachePublicCatalogs && opts.CacheAgeCatalogs == 0) ||
-		(opts.CachePublicStreams && opts.CacheAgeStreams == 0) {
+		(opts.CachePublicStreams && opts.CacheAgeStreams == 0) ||
+		(opts.CachePublicMeta && opts.CacheAgeMeta == 0) ||
+		(opts.CachePublicSubtitles && opts.CacheAgeSubtitles == 0) {
 		return nil, errors.New("enabling public caching only makes sense when also setting a cache age")
 	} else if (opts.HandleEtagCatalogs && opts.CacheAgeCatalogs == 0) ||
-		(opts.HandleEtagStreams && opts.CacheAgeStreams == 0) {
+		(opts.HandleEtagStreams && opts.CacheAgeStreams == 0) ||
+		(opts.HandleEtagMeta && opts.CacheAgeMeta == 0) ||
+		(opts.HandleEtagSubtitles && opts.CacheAgeSubtitles == 0) {
 		return nil, errors.New("etag handling only makes sense when also setting a cache age")
 	} else if opts.DisableRequestLogging && (opts.LogIPs || opts.LogUserAgent) {
 		return nil, errors.New("enabling IP or user agent logging doesn't make sense when disabling request logging")
@@ -103,14 +139,30 @@ func NewAddon(manifest Manifest, catalogHandlers map[string]CatalogHandler, stre
 		return nil, errors.New("setting a logging level in the options doesn't make sense when you already set a custom logger")
 	} else if opts.DisableRequestLogging && opts.LogMediaName {
 		return nil, errors.New("enabling media name logging doesn't make sense when disabling request logging")
-	} else if opts.MetaClient != nil && !opts.LogMediaName && !opts.PutMetaInContext {
-		return nil, errors.New("setting a meta client when neither logging the media name nor putting it in the context doesn't make sense")
-	} else if opts.MetaClient != nil && opts.CinemetaTimeout != 0 {
-		return nil, errors.New("setting a Cinemeta timeout doesn't make sense when you already set a meta client")
+	} else if opts.MetaClient != nil && opts.MetaProvider != nil {
+		return nil, errors.New("setting both a meta client and a meta provider doesn't make sense")
+	} else if (opts.MetaClient != nil || opts.MetaProvider != nil) && !opts.LogMediaName && !opts.PutMetaInContext && !opts.EnrichCatalogs {
+		return nil, errors.New("setting a meta client or provider when neither logging the media name, putting it in the context nor enriching catalogs doesn't make sense")
+	} else if opts.ContinueWithoutMeta && !opts.LogMediaName && !opts.PutMetaInContext {
+		return nil, errors.New("continuing without meta only makes sense when also logging the media name or putting it in the context")
+	} else if (opts.MetaClient != nil || opts.MetaProvider != nil) && opts.CinemetaTimeout != 0 {
+		return nil, errors.New("setting a Cinemeta timeout doesn't make sense when you already set a meta client or provider")
 	} else if manifest.BehaviorHints.ConfigurationRequired && !manifest.BehaviorHints.Configurable {
 		return nil, errors.New("requiring a configuration only makes sense when also making the addon configurable")
 	} else if opts.ConfigureHTMLfs != nil && !manifest.BehaviorHints.Configurable {
 		return nil, errors.New("setting a ConfigureHTMLfs only makes sense when also making the addon configurable")
+	} else if !opts.Profiling && (opts.ProfilingAddr != "" || opts.ProfilingToken != "") {
+		return nil, errors.New("setting a profiling address or token only makes sense when also enabling profiling")
+	} else if opts.PathPrefix != "" && !strings.HasPrefix(opts.PathPrefix, "/") {
+		return nil, errors.New("the path prefix must start with a slash")
+	} else if (opts.ServerCacheCatalogs && opts.CacheAgeCatalogs == 0) ||
+		(opts.ServerCacheStreams && opts.CacheAgeStreams == 0) {
+		return nil, errors.New("server-side caching only makes sense when also setting a cache age")
+	} else if ((opts.StaleRevalidateCatalogs != 0 || opts.StaleErrorCatalogs != 0) && opts.CacheAgeCatalogs == 0) ||
+		((opts.StaleRevalidateStreams != 0 || opts.StaleErrorStreams != 0) && opts.CacheAgeStreams == 0) {
+		return nil, errors.New("serving stale responses only makes sense when also setting a cache age")
+	} else if opts.EnrichPolicy != EnrichmentKeepSparse && !opts.EnrichCatalogs {
+		return nil, errors.New("setting an enrichment policy only makes sense when also enabling catalog enrichment")
 	}
 
 	// Set default values
@@ -129,34 +181,59 @@ func NewAddon(manifest Manifest, catalogHandlers map[string]CatalogHandler, stre
 	if opts.CinemetaTimeout == 0 {
 		opts.CinemetaTimeout = DefaultOptions.CinemetaTimeout
 	}
+	if opts.ShutdownTimeout == 0 {
+		opts.ShutdownTimeout = DefaultOptions.ShutdownTimeout
+	}
+	if opts.ServerCacheSize == 0 {
+		opts.ServerCacheSize = DefaultOptions.ServerCacheSize
+	}
+	if opts.EnrichConcurrency == 0 {
+		opts.EnrichConcurrency = DefaultOptions.EnrichConcurrency
+	}
+	if opts.EnrichTimeout == 0 {
+		opts.EnrichTimeout = DefaultOptions.EnrichTimeout
+	}
+
+	// Configure server-side cache if enabled and no custom one is set
+	if opts.ServerCache == nil && (opts.ServerCacheCatalogs || opts.ServerCacheStreams) {
+		opts.ServerCache = NewLRUResponseCache(opts.ServerCacheSize)
+	}
 
 	// Configure logger if no custom one is set
 	if opts.Logger == nil {
 		opts.Logger = NewLogger(opts.LoggingLevel, opts.LogEncoding)
 	}
 
-	// Configure Cinemeta client if no custom MetaFetcher is set
-	if opts.MetaClient == nil && (opts.LogMediaName || opts.PutMetaInContext) {
-		cinemetaCache := cinemeta.NewInMemoryCache()
+	// Configure Cinemeta client if no custom MetaFetcher or MetaProvider is set
+	var defaultMetaClient *cinemeta.Client
+	if opts.MetaClient == nil && opts.MetaProvider == nil && (opts.LogMediaName || opts.PutMetaInContext || opts.EnrichCatalogs) {
 		cinemetaOpts := cinemeta.ClientOptions{
 			Timeout: opts.CinemetaTimeout,
 		}
-		opts.MetaClient = cinemeta.NewClient(cinemetaOpts, cinemetaCache, opts.Logger)
+		// A nil cache leads to a bounded LRU cache
+		defaultMetaClient = cinemeta.NewClient(cinemetaOpts, nil, opts.Logger)
+		opts.MetaClient = defaultMetaClient
+	}
+
+	metaProvider := opts.MetaProvider
+	if opts.MetaClient != nil {
+		metaProvider = NewCinemetaProvider(opts.MetaClient)
 	}
 
 	// Create and return addon
 	return &Addon{
-		manifest:        manifest,
-		catalogHandlers: catalogHandlers,
-		streamHandlers:  streamHandlers,
-		opts:            opts,
-		logger:          opts.Logger,
-		metaClient:      opts.MetaClient,
+		manifest:          manifest,
+		catalogHandlers:   catalogHandlers,
+		streamHandlers:    streamHandlers,
+		opts:              opts,
+		logger:            opts.Logger,
+		metaProvider:      metaProvider,
+		defaultMetaClient: defaultMetaClient,
 	}, nil
 }
 
 // RegisterUserData registers the type of userData, so the addon can automatically unmarshal user data into an object of this type
-// and pass the object into the manifest callback or catalog and stream handlers.
+// and pass the object into the manifest callback or catalog, stream, meta and subtitles handlers.
 func (a *Addon) RegisterUserData(userDataObject any) {
 	t := reflect.TypeOf(userDataObject)
 	if t.Kind() == reflect.Ptr {
@@ -189,6 +266,54 @@ func (a *Addon) AddEndpoint(method, path string, handler http.HandlerFunc) {
 	a.customEndpoints = append(a.customEndpoints, customEndpoint)
 }
 
+// Use adds middlewares that wrap all requests to the addon, for example for authentication, rate limiting or adding headers.
+// They're called in the order they were added, within the logging, CORS and metrics middlewares and before the request is routed.
+// The request path doesn't contain the PathPrefix of the options.
+// Use UseFor() for middlewares that should only wrap requests for a specific resource.
+func (a *Addon) Use(mws ...func(http.Handler) http.Handler) {
+	for _, mw := range mws {
+		a.customMiddlewares = append(a.customMiddlewares, customMiddleware{mw: mw})
+	}
+}
+
+// UseFor adds middlewares that only wrap the requests for the given resource.
+// Valid resources are "manifest", "catalog", "stream", "meta", "subtitles" and "addon_catalog".
+// The middlewares are called in the order they were added, after the ones added with Use(),
+// but before the requests are validated and before the meta middleware of stream requests.
+// For resource requests they can access the "userData", "type", "id" and "extra" path values with r.PathValue(),
+// for manifest requests only "userData".
+func (a *Addon) UseFor(resource string, mws ...func(http.Handler) http.Handler) {
+	for _, mw := range mws {
+		a.customMiddlewares = append(a.customMiddlewares, customMiddleware{resource: resource, mw: mw})
+	}
+}
+
+// middlewaresFor returns the middlewares that were added for the given resource, or with Use() for an empty resource.
+func (a *Addon) middlewaresFor(resource string) []func(http.Handler) http.Handler {
+	var mws []func(http.Handler) http.Handler
+	for _, customMiddleware := range a.customMiddlewares {
+		if customMiddleware.resource == resource {
+			mws = append(mws, customMiddleware.mw)
+		}
+	}
+	return mws
+}
+
+// SetMetaHandlers sets the handlers for meta requests, one per type (like "movie").
+// It's a setter instead of a NewAddon() parameter so that existing NewAddon() calls keep working.
+// Meta requests are only handled if this was called before running the addon.
+// An addon with only meta handlers can pass nil for the catalog and stream handlers in NewAddon().
+func (a *Addon) SetMetaHandlers(handlers map[string]MetaHandler) {
+	a.metaHandlers = handlers
+}
+
+// SetAddonCatalogHandlers sets the handlers for addon catalog requests, one per type (like "all").
+// Addon catalog requests are only handled if this was called before running the addon.
+// They use the same cache options as catalogs (CacheAgeCatalogs etc.).
+func (a *Addon) SetAddonCatalogHandlers(handlers map[string]AddonCatalogHandler) {
+	a.addonCatalogHandlers = handlers
+}
+
 // SetManifestCallback sets the manifest callback
 func (a *Addon) SetManifestCallback(callback ManifestCallback) {
 	a.manifestCallback = callback
@@ -207,50 +332,306 @@ func (a *Addon) SetConfigurationUI(ui *ConfigurationUI) {
 // Run starts the remote addon. It sets up an HTTP server that handles requests to "/manifest.json" etc. and gracefully handles shutdowns.
 // The call is *blocking*, so use the stoppingChan param if you want to be notified when the addon is about to shut down
 // because of a system signal like Ctrl+C or `docker stop`. It should be a buffered channel with a capacity of 1.
-func (a *Addon) Run(stoppingChan chan bool) {
-	logger := a.logger
-
+// It returns an error if the server couldn't be started or shut down gracefully.
+// If you want to handle system signals yourself, use RunContext() instead.
+func (a *Addon) Run(stoppingChan chan bool) error {
 	// Make sure the passed channel is buffered, so we can send a message before shutting down and not be blocked by the channel.
 	if stoppingChan != nil && cap(stoppingChan) < 1 {
-		logger.Error("The passed stopping channel isn't buffered")
-		os.Exit(1)
+		return errors.New("the passed stopping channel isn't buffered")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Handle shutdown
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(c)
+		select {
+		case sig := <-c:
+			a.logger.Info("Received signal, shutting down server...", "signal", sig)
+			if stoppingChan != nil {
+				stoppingChan <- true
+			}
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return a.RunContext(ctx)
+}
+
+// RunContext starts the remote addon on the address and port configured in the options.
+// The call is *blocking* until the context is canceled, after which the server is shut down gracefully.
+// Unlike Run() it doesn't handle system signals, so the caller is in control of the addon's lifetime.
+// It returns an error if the server couldn't be started or shut down within the ShutdownTimeout.
+func (a *Addon) RunContext(ctx context.Context) error {
+	return a.ListenAndServe(ctx, a.opts.BindAddr+":"+strconv.Itoa(a.opts.Port))
+}
+
+// ListenAndServe is like RunContext(), but listens on the given address (like "localhost:8080")
+// instead of the one configured in the options.
+func (a *Addon) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("couldn't listen on %v: %w", addr, err)
+	}
+	return a.Serve(ctx, l)
+}
+
+// Serve is like RunContext(), but accepts connections on the given listener.
+// This can be useful for tests or socket activation for example.
+// The listener is closed when the call returns, and so is the Cinemeta client that NewAddon created if no MetaClient was set.
+func (a *Addon) Serve(ctx context.Context, l net.Listener) error {
+	logger := a.logger
+	if a.defaultMetaClient != nil {
+		defer a.defaultMetaClient.Close()
+	}
+
+	handler, err := a.Handler()
+	if err != nil {
+		l.Close()
+		return err
+	}
+
+	servers := []*http.Server{{Handler: handler}}
+	listeners := []net.Listener{l}
+
+	// The profiling endpoints get their own server if configured, so they're not exposed on the public addon port
+	if a.opts.Profiling && a.opts.ProfilingAddr != "" {
+		profilingListener, err := net.Listen("tcp", a.opts.ProfilingAddr)
+		if err != nil {
+			l.Close()
+			return fmt.Errorf("couldn't listen on %v for profiling: %w", a.opts.ProfilingAddr, err)
+		}
+		servers = append(servers, &http.Server{Handler: createProfilingHandler(a.opts.ProfilingToken)})
+		listeners = append(listeners, profilingListener)
+	}
+
+	// Start servers
+	errChan := make(chan error, len(servers))
+	for i, server := range servers {
+		logger.Info("Starting server", "address", listeners[i].Addr().String())
+		go func() {
+			errChan <- server.Serve(listeners[i])
+		}()
+	}
+
+	select {
+	case err := <-errChan:
+		for _, server := range servers {
+			server.Close()
+		}
+		return fmt.Errorf("couldn't serve: %w", err)
+	case <-ctx.Done():
+	}
+
+	// Create shutdown context with timeout
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.opts.ShutdownTimeout)
+	defer cancel()
+
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("couldn't shut down server gracefully: %w", err)
+		}
+	}
+
+	logger.Info("Finished shutting down server")
+	return nil
+}
+
+// Handler returns the addon as http.Handler, with the same endpoints and middlewares that Run() serves.
+// Requests pass the middlewares in this order: logging, CORS, metrics, the ones added with Use(), routing,
+// the ones added with UseFor(), request validation, the meta middleware (stream requests only) and finally the handler.
+// It can be used to mount the addon in an existing http.ServeMux, run it behind your own http.Server or test it with httptest.
+// If you set a PathPrefix in the options, the handler expects all request paths to start with it,
+// so for example two addons with the prefixes "/a" and "/b" can be mounted at "/a/" and "/b/" of the same mux.
+func (a *Addon) Handler() (http.Handler, error) {
+	// Create mux with all endpoints
+	mux, err := a.createMux()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create routes: %w", err)
+	}
+
+	// Add custom middlewares
+	handler := chainMiddlewares(mux, a.middlewaresFor(""))
+
+	// Add metrics middleware if enabled
+	if a.opts.Metrics {
+		handler = createMetricsMiddleware()(handler)
+	}
+
+	// Create server with CORS middleware
+	handler = cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+		AllowedHeaders: []string{"Accept", "Content-Type", "X-Requested-With"},
+	}).Handler(withPathPrefix(a.opts.PathPrefix, handler))
+
+	// Add logging middleware if not disabled
+	if !a.opts.DisableRequestLogging {
+		handler = createSlogLoggingMiddleware(a.logger, a.opts.LogIPs, a.opts.LogUserAgent, a.opts.LogMediaName, a.manifest.BehaviorHints.ConfigurationRequired)(handler)
+	}
+
+	return handler, nil
+}
+
+// createMux creates the mux with the health, manifest, resource, configuration and custom endpoints.
+// It returns an error if no catalog, stream, meta, subtitles or addon catalog handlers are set or if an ID regex is invalid.
+func (a *Addon) createMux() (*http.ServeMux, error) {
+	logger := a.logger
+
+	if a.catalogHandlers == nil && a.streamHandlers == nil && a.metaHandlers == nil && a.subtitleHandlers == nil && a.addonCatalogHandlers == nil {
+		return nil, errors.New("no handlers were set")
+	}
+
+	idRegexes, err := a.compileIDregexes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, customMiddleware := range a.customMiddlewares {
+		if customMiddleware.resource != "" && !slices.Contains(resourceNames, customMiddleware.resource) {
+			return nil, fmt.Errorf("middleware was added for unknown resource %q", customMiddleware.resource)
+		}
+	}
+	for resource := range a.opts.EmptyResponses {
+		if resource == "manifest" || !slices.Contains(resourceNames, resource) {
+			return nil, fmt.Errorf("empty responses were configured for unsupported resource %q", resource)
+		}
 	}
 
-	// Create mux
 	mux := http.NewServeMux()
 
 	// Add health check endpoint
 	mux.HandleFunc("/health", createHealthHandler(logger))
 
+	// Add metrics endpoint if enabled
+	if a.opts.Metrics {
+		mux.HandleFunc("/metrics", createMetricsHandler())
+	}
+
+	// Add profiling endpoints if enabled and not served on a separate address
+	if a.opts.Profiling && a.opts.ProfilingAddr == "" {
+		mux.Handle("/debug/pprof/", createProfilingHandler(a.opts.ProfilingToken))
+	}
+
 	// Add manifest endpoint
-	manifestHandler := createManifestHandler(a.manifest, logger, a.manifestCallback, a.userDataType, a.opts.UserDataIsBase64)
-	mux.HandleFunc("/manifest.json", manifestHandler)
-	mux.HandleFunc("/{userData}/manifest.json", manifestHandler)
+	manifestHandler := chainMiddlewares(createManifestHandler(a.manifest, logger, a.manifestCallback, a.userDataType, a.opts.UserDataIsBase64), a.middlewaresFor("manifest"))
+	mux.Handle("/manifest.json", manifestHandler)
+	mux.Handle("/{userData}/manifest.json", manifestHandler)
+
+	// Resource requests are routed by the resource router, which is the catch-all handler of the mux.
+	// Each resource handler is wrapped in a middleware that validates the request against the manifest and options.
+	var fallbackHandler http.Handler = http.NotFoundHandler()
+	if a.opts.RedirectURL != "" {
+		fallbackHandler = createRootHandler(a.opts.RedirectURL, logger)
+	}
+	router := newResourceRouter(fallbackHandler)
+	mux.Handle("/", router)
+	handleResource := func(resource string, handler http.Handler, extra bool) {
+		validator := newRequestValidator(resource, a.manifest, idRegexes[resource])
+		handler = createValidationMiddleware(validator)(handler)
+		router.handle(resource, chainMiddlewares(handler, a.middlewaresFor(resource)), extra)
+	}
 
 	// Add catalog endpoint if handlers are set
 	if a.catalogHandlers != nil {
-		catalogHandler := createCatalogHandler(a.catalogHandlers, int(a.opts.CacheAgeCatalogs.Seconds()), a.opts.CachePublicCatalogs, a.opts.HandleEtagCatalogs, logger, a.userDataType, a.opts.UserDataIsBase64)
-		if !a.manifest.BehaviorHints.ConfigurationRequired {
-			mux.HandleFunc("/catalog/{type}/{id}", catalogHandler)
+		catalogCfg := resourceConfig{
+			cacheAge:        int(a.opts.CacheAgeCatalogs.Seconds()),
+			cachePublic:     a.opts.CachePublicCatalogs,
+			handleEtag:      a.opts.HandleEtagCatalogs,
+			metrics:         a.opts.Metrics,
+			staleRevalidate: int(a.opts.StaleRevalidateCatalogs.Seconds()),
+			staleError:      int(a.opts.StaleErrorCatalogs.Seconds()),
+			emptyResponse:   a.opts.EmptyResponses["catalog"],
+		}
+		if a.opts.ServerCacheCatalogs {
+			catalogCfg.responseCache = a.opts.ServerCache
 		}
-		mux.HandleFunc("/{userData}/catalog/{type}/{id}", catalogHandler)
+		if a.opts.CoalesceCatalogs {
+			catalogCfg.coalescer = &singleflight.Group[CachedResponse]{}
+		}
+		catalogHandlers := a.catalogHandlers
+		if a.opts.EnrichCatalogs {
+			enricher := &catalogEnricher{
+				metaProvider: a.metaProvider,
+				concurrency:  a.opts.EnrichConcurrency,
+				timeout:      a.opts.EnrichTimeout,
+				policy:       a.opts.EnrichPolicy,
+				logger:       logger,
+			}
+			catalogHandlers = make(map[string]CatalogHandler, len(a.catalogHandlers))
+			for t, handler := range a.catalogHandlers {
+				catalogHandlers[t] = enricher.wrap(handler, t)
+			}
+		}
+		catalogHandler := createCatalogHandler(catalogHandlers, a.manifest.Catalogs, catalogCfg, logger, a.userDataType, a.opts.UserDataIsBase64)
+		handleResource("catalog", catalogHandler, true)
 	}
 
 	// Add stream endpoint if handlers are set
 	if a.streamHandlers != nil {
-		streamHandler := createStreamHandler(a.streamHandlers, int(a.opts.CacheAgeStreams.Seconds()), a.opts.CachePublicStreams, a.opts.HandleEtagStreams, logger, a.userDataType, a.opts.UserDataIsBase64)
-		if !a.manifest.BehaviorHints.ConfigurationRequired {
-			if a.metaClient != nil {
-				mux.Handle("/stream/{type}/{id}", createMetaMiddleware(a.metaClient, a.opts.PutMetaInContext, a.opts.LogMediaName, logger)(streamHandler))
-			} else {
-				mux.HandleFunc("/stream/{type}/{id}", streamHandler)
-			}
+		streamCfg := resourceConfig{
+			cacheAge:        int(a.opts.CacheAgeStreams.Seconds()),
+			cachePublic:     a.opts.CachePublicStreams,
+			handleEtag:      a.opts.HandleEtagStreams,
+			metrics:         a.opts.Metrics,
+			staleRevalidate: int(a.opts.StaleRevalidateStreams.Seconds()),
+			staleError:      int(a.opts.StaleErrorStreams.Seconds()),
+			emptyResponse:   a.opts.EmptyResponses["stream"],
+		}
+		if a.opts.ServerCacheStreams {
+			streamCfg.responseCache = a.opts.ServerCache
+		}
+		if a.opts.CoalesceStreams {
+			streamCfg.coalescer = &singleflight.Group[CachedResponse]{}
+		}
+		var streamHandler http.Handler = createStreamHandler(a.streamHandlers, streamCfg, logger, a.userDataType, a.opts.UserDataIsBase64)
+		if a.metaProvider != nil && (a.opts.PutMetaInContext || a.opts.LogMediaName) {
+			streamHandler = createMetaMiddleware(a.metaProvider, a.opts.PutMetaInContext, a.opts.LogMediaName, a.opts.ContinueWithoutMeta, logger)(streamHandler)
+		}
+		handleResource("stream", streamHandler, false)
+	}
+
+	// Add meta endpoint if handlers are set
+	if a.metaHandlers != nil {
+		metaCfg := resourceConfig{
+			cacheAge:      int(a.opts.CacheAgeMeta.Seconds()),
+			cachePublic:   a.opts.CachePublicMeta,
+			handleEtag:    a.opts.HandleEtagMeta,
+			metrics:       a.opts.Metrics,
+			emptyResponse: a.opts.EmptyResponses["meta"],
+		}
+		metaHandler := createMetaHandler(a.metaHandlers, metaCfg, logger, a.userDataType, a.opts.UserDataIsBase64)
+		handleResource("meta", metaHandler, false)
+	}
+
+	// Add subtitles endpoint if handlers are set
+	if a.subtitleHandlers != nil {
+		subtitleCfg := resourceConfig{
+			cacheAge:      int(a.opts.CacheAgeSubtitles.Seconds()),
+			cachePublic:   a.opts.CachePublicSubtitles,
+			handleEtag:    a.opts.HandleEtagSubtitles,
+			metrics:       a.opts.Metrics,
+			emptyResponse: a.opts.EmptyResponses["subtitles"],
 		}
-		if a.metaClient != nil {
-			mux.Handle("/{userData}/stream/{type}/{id}", createMetaMiddleware(a.metaClient, a.opts.PutMetaInContext, a.opts.LogMediaName, logger)(streamHandler))
-		} else {
-			mux.HandleFunc("/{userData}/stream/{type}/{id}", streamHandler)
+		subtitleHandler := createSubtitleHandler(a.subtitleHandlers, subtitleCfg, logger, a.userDataType, a.opts.UserDataIsBase64)
+		handleResource("subtitles", subtitleHandler, true)
+	}
+
+	// Add addon catalog endpoint if handlers are set
+	if a.addonCatalogHandlers != nil {
+		addonCatalogCfg := resourceConfig{
+			cacheAge:      int(a.opts.CacheAgeCatalogs.Seconds()),
+			cachePublic:   a.opts.CachePublicCatalogs,
+			handleEtag:    a.opts.HandleEtagCatalogs,
+			metrics:       a.opts.Metrics,
+			emptyResponse: a.opts.EmptyResponses["addon_catalog"],
 		}
+		addonCatalogHandler := createAddonCatalogHandler(a.addonCatalogHandlers, addonCatalogCfg, logger, a.userDataType, a.opts.UserDataIsBase64)
+		handleResource("addon_catalog", addonCatalogHandler, false)
 	}
 
 	// Add configuration endpoint if enabled
@@ -259,13 +640,15 @@ func (a *Addon) Run(stoppingChan chan bool) {
 			mux.HandleFunc("/configure", func(w http.ResponseWriter, r *http.Request) {
 				userData, err := a.DecodeUserData("userData", r)
 				if err != nil {
-					http.Error(w, "Invalid user data", http.StatusBadRequest)
+					writeError(w, http.StatusBadRequest, "Invalid user data")
 					return
 				}
 
 				config, err := a.configHandler(r.Context(), userData)
 				if err != nil {
-					http.Error(w, "Failed to get configuration", http.StatusInternalServerError)
+					handlerErr := toHandlerError(err, "Failed to get configuration")
+					logHandlerError(r.Context(), logger, handlerErr, "configuration")
+					writeHandlerError(w, handlerErr)
 					return
 				}
 
@@ -283,73 +666,54 @@ func (a *Addon) Run(stoppingChan chan bool) {
 		}
 	}
 
-	// Add root redirect if configured
-	if a.opts.RedirectURL != "" {
-		mux.HandleFunc("/", createRootHandler(a.opts.RedirectURL, logger))
-	}
-
 	// Add custom endpoints
 	for _, endpoint := range a.customEndpoints {
 		mux.HandleFunc(endpoint.path, endpoint.handler)
 	}
 
-	// Add route matcher middleware
-	var streamIDRegex *regexp.Regexp
-	if a.opts.StreamIDregex != "" {
-		var err error
-		streamIDRegex, err = regexp.Compile(a.opts.StreamIDregex)
-		if err != nil {
-			logger.Error("Invalid stream ID regex", "error", err)
-			os.Exit(1)
-		}
-	}
-	addRouteMatcherMiddleware(mux, a.manifest.BehaviorHints.ConfigurationRequired, streamIDRegex, logger)
-
-	// Create server with CORS middleware
-	corsHandler := cors.New(cors.Options{
-		AllowedOrigins: []string{"*"},
-		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders: []string{"Accept", "Content-Type", "X-Requested-With"},
-	}).Handler(mux)
+	return mux, nil
+}
 
-	// Add logging middleware if not disabled
-	var handler http.Handler = corsHandler
-	if !a.opts.DisableRequestLogging {
-		handler = createSlogLoggingMiddleware(a.logger, a.opts.LogIPs, a.opts.LogUserAgent, a.opts.LogMediaName, a.manifest.BehaviorHints.ConfigurationRequired)(handler)
+// compileIDregexes compiles the ID regexes from the options, keyed by resource name.
+// It returns an error if a regex is invalid or set for an unknown resource, so that a typo doesn't silently disable the validation.
+// StreamIDregex is the regex for the "stream" resource, unless IDregexes contains one as well.
+func (a *Addon) compileIDregexes() (map[string]*regexp.Regexp, error) {
+	exprs := make(map[string]string, len(a.opts.IDregexes)+1)
+	if a.opts.StreamIDregex != "" {
+		exprs["stream"] = a.opts.StreamIDregex
 	}
-
-	server := &http.Server{
-		Addr:    a.opts.BindAddr + ":" + strconv.Itoa(a.opts.Port),
-		Handler: handler,
+	for resource, expr := range a.opts.IDregexes {
+		if resource == "manifest" || !slices.Contains(resourceNames, resource) {
+			return nil, fmt.Errorf("ID regex was set for unsupported resource %q", resource)
+		}
+		exprs[resource] = expr
 	}
 
-	// Start server
-	logger.Info("Starting server", "address", server.Addr)
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			logger.Error("Couldn't start server", "error", err)
-			os.Exit(1)
+	idRegexes := make(map[string]*regexp.Regexp, len(exprs))
+	for resource, expr := range exprs {
+		idRegex, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v ID regex: %w", resource, err)
 		}
-	}()
-
-	// Handle shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	sig := <-c
-	logger.Info("Received signal, shutting down server...", "signal", sig)
-
-	if stoppingChan != nil {
-		stoppingChan <- true
+		idRegexes[resource] = idRegex
 	}
+	return idRegexes, nil
+}
 
-	// Create shutdown context with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	if err := server.Shutdown(ctx); err != nil {
-		logger.Error("Error shutting down server", "error", err)
-		os.Exit(1)
+// withPathPrefix strips the given prefix from request paths before passing the requests to the handler.
+// Requests with paths that aren't the prefix or don't start with the prefix followed by a slash lead to a "404 Not Found" response,
+// so for example an addon with the prefix "/a" doesn't handle "/ab/manifest.json".
+func withPathPrefix(prefix string, handler http.Handler) http.Handler {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return handler
 	}
-
-	logger.Info("Finished shutting down server")
+	stripped := http.StripPrefix(prefix, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
 }
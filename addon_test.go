@@ -1,12 +1,26 @@
 package stremio
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Dasio/go-stremio/pkg/cinemeta"
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/stretchr/testify/require"
 )
 
@@ -49,7 +63,12 @@ func TestBasicAddon(t *testing.T) {
 	// Create a test server with the addon's handlers
 	mux := http.NewServeMux()
 	mux.HandleFunc("/manifest.json", createManifestHandler(manifest, addon.logger, addon.manifestCallback, addon.userDataType, addon.opts.UserDataIsBase64))
-	mux.HandleFunc("/stream/{type}/{id}", createStreamHandler(streamHandlers, int(addon.opts.CacheAgeStreams.Seconds()), addon.opts.CachePublicStreams, addon.opts.HandleEtagStreams, addon.logger, addon.userDataType, addon.opts.UserDataIsBase64))
+	streamCfg := resourceConfig{
+		cacheAge:    int(addon.opts.CacheAgeStreams.Seconds()),
+		cachePublic: addon.opts.CachePublicStreams,
+		handleEtag:  addon.opts.HandleEtagStreams,
+	}
+	mux.HandleFunc("/stream/{type}/{id}", createStreamHandler(streamHandlers, streamCfg, addon.logger, addon.userDataType, addon.opts.UserDataIsBase64))
 
 	server := httptest.NewServer(mux)
 	defer server.Close()
@@ -89,3 +108,1982 @@ func TestBasicAddon(t *testing.T) {
 		require.Equal(t, http.StatusNotFound, resp.StatusCode)
 	})
 }
+
+func TestMetaAddon(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		ResourceItems: []ResourceItem{
+			{
+				Name:  "meta",
+				Types: []string{"movie"},
+			},
+		},
+		Types:      []string{"movie"},
+		IDprefixes: []string{"tt"},
+	}
+
+	type customer struct {
+		UserID string `json:"userId"`
+	}
+	metaHandlers := map[string]MetaHandler{
+		"movie": func(ctx context.Context, id string, userData any) (MetaItem, error) {
+			if id != "tt1254207" {
+				return MetaItem{}, ErrNotFound
+			}
+			name := "Big Buck Bunny"
+			// Put the user ID into the name so the test can check the user data decoding
+			if u, ok := userData.(*customer); ok {
+				name += " for " + u.UserID
+			}
+			return MetaItem{ID: id, Type: "movie", Name: name}, nil
+		},
+	}
+
+	opts := Options{
+		CacheAgeMeta:   time.Hour,
+		HandleEtagMeta: true,
+	}
+	addon, err := NewAddon(manifest, nil, nil, opts)
+	require.NoError(t, err)
+	addon.SetMetaHandlers(metaHandlers)
+	addon.RegisterUserData(customer{})
+
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	getMeta := func(t *testing.T, path string) MetaItem {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result struct {
+			Meta MetaItem `json:"meta"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		require.NoError(t, err)
+		return result.Meta
+	}
+
+	t.Run("meta", func(t *testing.T) {
+		meta := getMeta(t, "/meta/movie/tt1254207.json")
+		require.Equal(t, "tt1254207", meta.ID)
+		require.Equal(t, "Big Buck Bunny", meta.Name)
+	})
+
+	t.Run("meta with user data", func(t *testing.T) {
+		// URL-escaped `{"userId":"123"}`
+		meta := getMeta(t, "/%7B%22userId%22%3A%22123%22%7D/meta/movie/tt1254207.json")
+		require.Equal(t, "Big Buck Bunny for 123", meta.Name)
+	})
+
+	t.Run("meta not found", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/meta/movie/tt0000000.json")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/meta/series/tt1254207.json")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("cache and etag", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/meta/movie/tt1254207.json")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Contains(t, resp.Header.Get("Cache-Control"), "max-age=3600")
+		etag := resp.Header.Get("ETag")
+		require.NotEmpty(t, etag)
+
+		req, err := http.NewRequest(http.MethodGet, server.URL+"/meta/movie/tt1254207.json", nil)
+		require.NoError(t, err)
+		req.Header.Set("If-None-Match", etag)
+		resp, err = http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	})
+
+	t.Run("configuration required", func(t *testing.T) {
+		manifest := manifest.clone()
+		manifest.BehaviorHints = BehaviorHints{
+			Configurable:          true,
+			ConfigurationRequired: true,
+		}
+		addon, err := NewAddon(manifest, nil, nil, Options{})
+		require.NoError(t, err)
+		addon.SetMetaHandlers(metaHandlers)
+
+		mux, err := addon.createMux()
+		require.NoError(t, err)
+		server := httptest.NewServer(mux)
+		defer server.Close()
+
+		resp, err := http.Get(server.URL + "/meta/movie/tt1254207.json")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+		resp, err = http.Get(server.URL + "/foo/meta/movie/tt1254207.json")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("no handlers", func(t *testing.T) {
+		addon, err := NewAddon(manifest, nil, nil, Options{})
+		require.NoError(t, err)
+		_, err = addon.createMux()
+		require.Error(t, err)
+	})
+}
+
+func TestCatalogExtra(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+		Catalogs: []CatalogItem{
+			{
+				Type: "movie",
+				ID:   "top",
+				Name: "Top movies",
+				Extra: []ExtraItem{
+					{Name: "search"},
+					{Name: "skip"},
+					{Name: "genre", Options: []string{"Action", "Drama"}},
+				},
+			},
+			{
+				Type: "movie",
+				ID:   "search",
+				Name: "Search",
+				Extra: []ExtraItem{
+					{Name: "search", IsRequired: true},
+				},
+			},
+		},
+	}
+
+	// The handler returns the received extra arguments as meta preview, so the test can check them
+	catalogHandlers := map[string]CatalogHandler{
+		"movie": func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error) {
+			return []MetaPreviewItem{{
+				ID:          id,
+				Name:        extra.Search,
+				ReleaseInfo: strconv.Itoa(extra.Skip),
+				Genres:      []string{extra.Genre},
+			}}, nil
+		},
+	}
+
+	addon, err := NewAddon(manifest, catalogHandlers, nil, Options{})
+	require.NoError(t, err)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		item   MetaPreviewItem
+	}{
+		{
+			name:   "no extra",
+			path:   "/catalog/movie/top.json",
+			status: http.StatusOK,
+			item:   MetaPreviewItem{ID: "top", ReleaseInfo: "0", Genres: []string{""}},
+		},
+		{
+			name:   "search and skip",
+			path:   "/catalog/movie/top/search=big%20buck&skip=100.json",
+			status: http.StatusOK,
+			item:   MetaPreviewItem{ID: "top", Name: "big buck", ReleaseInfo: "100", Genres: []string{""}},
+		},
+		{
+			name:   "escaped ampersand",
+			path:   "/catalog/movie/top/search=a%26b.json",
+			status: http.StatusOK,
+			item:   MetaPreviewItem{ID: "top", Name: "a&b", ReleaseInfo: "0", Genres: []string{""}},
+		},
+		{
+			name:   "with user data",
+			path:   "/foo/catalog/movie/top/genre=Drama.json",
+			status: http.StatusOK,
+			item:   MetaPreviewItem{ID: "top", ReleaseInfo: "0", Genres: []string{"Drama"}},
+		},
+		{
+			name:   "undeclared extra",
+			path:   "/catalog/movie/top/foo=bar.json",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid skip",
+			path:   "/catalog/movie/top/skip=abc.json",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "invalid option",
+			path:   "/catalog/movie/top/genre=Comedy.json",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "options limit",
+			path:   "/catalog/movie/top/genre=Action&genre=Drama.json",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "missing required extra",
+			path:   "/catalog/movie/search.json",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "required extra",
+			path:   "/catalog/movie/search/search=foo.json",
+			status: http.StatusOK,
+			item:   MetaPreviewItem{ID: "search", Name: "foo", ReleaseInfo: "0", Genres: []string{""}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + test.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, test.status, resp.StatusCode)
+			if test.status != http.StatusOK {
+				return
+			}
+
+			var result struct {
+				Metas []MetaPreviewItem `json:"metas"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&result)
+			require.NoError(t, err)
+			require.Equal(t, []MetaPreviewItem{test.item}, result.Metas)
+		})
+	}
+}
+
+func TestSubtitles(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		ResourceItems: []ResourceItem{
+			{
+				Name:  "subtitles",
+				Types: []string{"movie"},
+			},
+		},
+		Types:      []string{"movie"},
+		IDprefixes: []string{"tt"},
+	}
+
+	// The handler returns the received extra arguments as subtitle, so the test can check them
+	subtitleHandlers := map[string]SubtitleHandler{
+		"movie": func(ctx context.Context, id string, extra SubtitleExtra, userData any) ([]SubtitleItem, error) {
+			return []SubtitleItem{{
+				ID:       id,
+				URL:      extra.VideoHash,
+				Language: strconv.FormatInt(extra.VideoSize, 10),
+				Label:    extra.Filename,
+			}}, nil
+		},
+	}
+
+	addon, err := NewAddon(manifest, nil, nil, Options{CacheAgeSubtitles: time.Hour})
+	require.NoError(t, err)
+	addon.SetSubtitleHandlers(subtitleHandlers)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		item   SubtitleItem
+	}{
+		{
+			name:   "no extra",
+			path:   "/subtitles/movie/tt1254207.json",
+			status: http.StatusOK,
+			item:   SubtitleItem{ID: "tt1254207", Language: "0"},
+		},
+		{
+			name:   "extra",
+			path:   "/subtitles/movie/tt1254207/videoHash=8e245d9679d31e12&videoSize=12909756&filename=big%20buck%20bunny.mp4.json",
+			status: http.StatusOK,
+			item:   SubtitleItem{ID: "tt1254207", URL: "8e245d9679d31e12", Language: "12909756", Label: "big buck bunny.mp4"},
+		},
+		{
+			name:   "with user data",
+			path:   "/foo/subtitles/movie/tt1254207/videoHash=8e245d9679d31e12.json",
+			status: http.StatusOK,
+			item:   SubtitleItem{ID: "tt1254207", URL: "8e245d9679d31e12", Language: "0"},
+		},
+		{
+			name:   "invalid video size",
+			path:   "/subtitles/movie/tt1254207/videoSize=abc.json",
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + test.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, test.status, resp.StatusCode)
+			if test.status != http.StatusOK {
+				return
+			}
+			require.Contains(t, resp.Header.Get("Cache-Control"), "max-age=3600")
+
+			var result struct {
+				Subtitles []SubtitleItem `json:"subtitles"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&result)
+			require.NoError(t, err)
+			require.Equal(t, []SubtitleItem{test.item}, result.Subtitles)
+		})
+	}
+}
+
+func TestAddonCatalog(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		ResourceItems: []ResourceItem{
+			{
+				Name:  "addon_catalog",
+				Types: []string{"all"},
+			},
+		},
+		Types: []string{"all"},
+		AddonCatalogs: []CatalogItem{
+			{
+				Type: "all",
+				ID:   "recommended",
+				Name: "Recommended addons",
+			},
+		},
+	}
+
+	addonCatalogHandlers := map[string]AddonCatalogHandler{
+		"all": func(ctx context.Context, id string, userData any) ([]AddonDescriptor, error) {
+			if id != "recommended" {
+				return nil, ErrNotFound
+			}
+			return []AddonDescriptor{{
+				TransportURL:  "https://v3-cinemeta.strem.io/manifest.json",
+				TransportName: "http",
+				Manifest: Manifest{
+					ID:          "com.linvo.cinemeta",
+					Name:        "Cinemeta",
+					Description: "The official addon for movie and series catalogs",
+					Version:     "3.0.0",
+				},
+			}}, nil
+		},
+	}
+
+	addon, err := NewAddon(manifest, nil, nil, Options{})
+	require.NoError(t, err)
+	addon.SetAddonCatalogHandlers(addonCatalogHandlers)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	t.Run("manifest", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/manifest.json")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var m Manifest
+		err = json.NewDecoder(resp.Body).Decode(&m)
+		require.NoError(t, err)
+		require.Equal(t, manifest.AddonCatalogs, m.AddonCatalogs)
+	})
+
+	t.Run("addon catalog", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/addon_catalog/all/recommended.json")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var result struct {
+			Addons []AddonDescriptor `json:"addons"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		require.NoError(t, err)
+		require.Len(t, result.Addons, 1)
+		require.Equal(t, "https://v3-cinemeta.strem.io/manifest.json", result.Addons[0].TransportURL)
+		require.Equal(t, "com.linvo.cinemeta", result.Addons[0].Manifest.ID)
+	})
+
+	t.Run("addon catalog not found", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/addon_catalog/all/foo.json")
+		require.NoError(t, err)
+		require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	})
+}
+
+func TestServe(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			return nil, ErrNotFound
+		},
+	}
+	addon, err := NewAddon(manifest, nil, streamHandlers, Options{DisableRequestLogging: true})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- addon.Serve(ctx, l)
+	}()
+
+	resp, err := http.Get("http://" + l.Addr().String() + "/health")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// Canceling the context must lead to a graceful shutdown without error
+	cancel()
+	require.NoError(t, <-errChan)
+
+	// Errors are returned instead of exiting the process
+	addon, err = NewAddon(manifest, nil, streamHandlers, Options{StreamIDregex: "("})
+	require.NoError(t, err)
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.Error(t, addon.Serve(context.Background(), l))
+}
+
+func TestHandlerWithPathPrefix(t *testing.T) {
+	createAddon := func(t *testing.T, name string) http.Handler {
+		manifest := Manifest{
+			ID:          "org.myexampleaddon." + name,
+			Version:     "1.0.0",
+			Name:        name,
+			Description: "simple example",
+			Types:       []string{"movie"},
+		}
+		streamHandlers := map[string]StreamHandler{
+			"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+				return []StreamItem{{URL: "https://example.com/" + name + ".mp4"}}, nil
+			},
+		}
+		addon, err := NewAddon(manifest, nil, streamHandlers, Options{PathPrefix: "/" + name, DisableRequestLogging: true})
+		require.NoError(t, err)
+		handler, err := addon.Handler()
+		require.NoError(t, err)
+		return handler
+	}
+
+	addonA := createAddon(t, "a")
+	mux := http.NewServeMux()
+	mux.Handle("/a/", addonA)
+	mux.Handle("/ab/", createAddon(t, "ab"))
+	mux.Handle("/b/", createAddon(t, "b"))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, name := range []string{"a", "ab", "b"} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + "/" + name + "/manifest.json")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var m Manifest
+			err = json.NewDecoder(resp.Body).Decode(&m)
+			require.NoError(t, err)
+			require.Equal(t, name, m.Name)
+
+			resp, err = http.Get(server.URL + "/" + name + "/stream/movie/tt1254207.json")
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+			var result struct {
+				Streams []StreamItem `json:"streams"`
+			}
+			err = json.NewDecoder(resp.Body).Decode(&result)
+			require.NoError(t, err)
+			require.Equal(t, "https://example.com/"+name+".mp4", result.Streams[0].URL)
+		})
+	}
+
+	resp, err := http.Get(server.URL + "/manifest.json")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// An addon doesn't handle paths that only start with its prefix, like those of an addon mounted at "/ab/"
+	for _, path := range []string{"/ab/manifest.json", "/abmanifest.json"} {
+		rec := httptest.NewRecorder()
+		addonA.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		require.Equal(t, http.StatusNotFound, rec.Code, path)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			if id == "tt1254207" {
+				return []StreamItem{{URL: "https://example.com/movie.mp4"}}, nil
+			}
+			return nil, errors.New("upstream error")
+		},
+	}
+	addon, err := NewAddon(manifest, nil, streamHandlers, Options{Metrics: true, DisableRequestLogging: true})
+	require.NoError(t, err)
+	handler, err := addon.Handler()
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Metrics are global, so only the difference is checked
+	handlerErrors := metrics.GetOrCreateCounter(`handler_errors_total{resource="stream",type="movie"}`)
+	handlerErrorsBefore := handlerErrors.Get()
+
+	resp, err := http.Get(server.URL + "/stream/movie/tt1254207.json")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.Get(server.URL + "/stream/movie/tt0000000.json")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	resp, err = http.Get(server.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `http_requests_total{endpoint="stream", status="200"}`)
+	require.Contains(t, string(body), `http_request_duration_seconds_bucket{endpoint="stream",type="movie",vmrange=`)
+	require.Contains(t, string(body), `handler_errors_total{resource="stream",type="movie"} `)
+	require.EqualValues(t, 1, handlerErrors.Get()-handlerErrorsBefore)
+	require.Contains(t, string(body), `cinemeta_cache_requests_total{result="hit"}`)
+}
+
+func TestProfiling(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			return nil, ErrNotFound
+		},
+	}
+
+	get := func(t *testing.T, opts Options, token string) int {
+		opts.DisableRequestLogging = true
+		addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+		require.NoError(t, err)
+		handler, err := addon.Handler()
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusNotFound, get(t, Options{}, ""))
+	require.Equal(t, http.StatusOK, get(t, Options{Profiling: true}, ""))
+	require.Equal(t, http.StatusUnauthorized, get(t, Options{Profiling: true, ProfilingToken: "secret"}, ""))
+	require.Equal(t, http.StatusUnauthorized, get(t, Options{Profiling: true, ProfilingToken: "secret"}, "wrong"))
+	require.Equal(t, http.StatusOK, get(t, Options{Profiling: true, ProfilingToken: "secret"}, "secret"))
+	// Served on a separate address, so not by the addon's handler
+	require.Equal(t, http.StatusNotFound, get(t, Options{Profiling: true, ProfilingAddr: "localhost:6060"}, ""))
+}
+
+func TestRequestValidation(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		ResourceItems: []ResourceItem{
+			{
+				Name:  "catalog",
+				Types: []string{"movie", "series"},
+			},
+			{
+				Name:       "stream",
+				Types:      []string{"movie"},
+				IDprefixes: []string{"kitsu:"},
+			},
+			{
+				Name: "meta",
+			},
+		},
+		Types:      []string{"movie"},
+		IDprefixes: []string{"tt"},
+	}
+
+	catalogHandler := func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error) {
+		return []MetaPreviewItem{}, nil
+	}
+	streamHandler := func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+		return []StreamItem{}, nil
+	}
+	metaHandler := func(ctx context.Context, id string, userData any) (MetaItem, error) {
+		return MetaItem{ID: id}, nil
+	}
+
+	newServer := func(t *testing.T, manifest Manifest, opts Options) *httptest.Server {
+		addon, err := NewAddon(manifest, map[string]CatalogHandler{"movie": catalogHandler, "series": catalogHandler}, map[string]StreamHandler{"movie": streamHandler, "series": streamHandler}, opts)
+		require.NoError(t, err)
+		addon.SetMetaHandlers(map[string]MetaHandler{"movie": metaHandler, "series": metaHandler})
+		mux, err := addon.createMux()
+		require.NoError(t, err)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	// requireStatus checks the status code and, for errors, the JSON error body.
+	requireStatus := func(t *testing.T, server *httptest.Server, path string, status int) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, status, resp.StatusCode, path)
+		if status != http.StatusOK {
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			var body struct {
+				Error string `json:"error"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.NotEmpty(t, body.Error)
+		}
+	}
+
+	t.Run("types", func(t *testing.T) {
+		server := newServer(t, manifest, Options{})
+		// The types of the resource item take precedence over the manifest's
+		requireStatus(t, server, "/catalog/series/foo.json", http.StatusOK)
+		requireStatus(t, server, "/catalog/channel/foo.json", http.StatusBadRequest)
+		requireStatus(t, server, "/stream/series/kitsu:1.json", http.StatusBadRequest)
+		// Resource items without types fall back to the manifest's
+		requireStatus(t, server, "/meta/movie/tt1254207.json", http.StatusOK)
+		requireStatus(t, server, "/meta/series/tt1254207.json", http.StatusBadRequest)
+	})
+
+	t.Run("ID prefixes", func(t *testing.T) {
+		server := newServer(t, manifest, Options{})
+		// The ID prefixes of the resource item take precedence over the manifest's
+		requireStatus(t, server, "/stream/movie/kitsu:1.json", http.StatusOK)
+		requireStatus(t, server, "/stream/movie/tt1254207.json", http.StatusBadRequest)
+		requireStatus(t, server, "/meta/movie/tt1254207.json", http.StatusOK)
+		requireStatus(t, server, "/meta/movie/kitsu:1.json", http.StatusBadRequest)
+		// Catalog IDs aren't media IDs, so they're not checked against the prefixes
+		requireStatus(t, server, "/catalog/movie/foo.json", http.StatusOK)
+	})
+
+	t.Run("ID regexes", func(t *testing.T) {
+		opts := Options{
+			StreamIDregex: `^kitsu:\d+$`,
+			IDregexes: map[string]string{
+				"meta": `^tt\d{7,}$`,
+			},
+		}
+		server := newServer(t, manifest, opts)
+		requireStatus(t, server, "/stream/movie/kitsu:1.json", http.StatusOK)
+		requireStatus(t, server, "/stream/movie/kitsu:foo.json", http.StatusBadRequest)
+		requireStatus(t, server, "/meta/movie/tt1254207.json", http.StatusOK)
+		requireStatus(t, server, "/meta/movie/tt123.json", http.StatusBadRequest)
+
+		// Invalid regexes and unknown resources (like the typo "streams") lead to an error
+		for _, idRegexes := range []map[string]string{{"stream": "("}, {"streams": "^tt"}, {"manifest": "^tt"}} {
+			addon, err := NewAddon(manifest, nil, map[string]StreamHandler{"movie": streamHandler}, Options{IDregexes: idRegexes})
+			require.NoError(t, err)
+			_, err = addon.createMux()
+			require.Error(t, err)
+		}
+	})
+
+	t.Run("user data required", func(t *testing.T) {
+		manifest := manifest.clone()
+		manifest.BehaviorHints = BehaviorHints{
+			Configurable:          true,
+			ConfigurationRequired: true,
+		}
+		server := newServer(t, manifest, Options{})
+		requireStatus(t, server, "/stream/movie/kitsu:1.json", http.StatusBadRequest)
+		requireStatus(t, server, "/foo/stream/movie/kitsu:1.json", http.StatusOK)
+		requireStatus(t, server, "/catalog/movie/foo.json", http.StatusBadRequest)
+		requireStatus(t, server, "/foo/catalog/movie/foo.json", http.StatusOK)
+	})
+
+	t.Run("handler errors", func(t *testing.T) {
+		server := newServer(t, manifest, Options{})
+		requireStatus(t, server, "/catalog/movie/foo/skip=-1.json", http.StatusBadRequest)
+	})
+}
+
+func TestMiddlewares(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+	catalogHandlers := map[string]CatalogHandler{
+		"movie": func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error) {
+			return []MetaPreviewItem{}, nil
+		},
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			return []StreamItem{}, nil
+		},
+	}
+
+	addon, err := NewAddon(manifest, catalogHandlers, streamHandlers, Options{DisableRequestLogging: true})
+	require.NoError(t, err)
+
+	// Each middleware appends its name to the "X-Middlewares" response header, so the test can check the order
+	record := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Middlewares", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	addon.Use(record("global1"), record("global2"))
+	addon.UseFor("stream", record("stream"))
+	addon.UseFor("manifest", record("manifest"))
+	addon.UseFor("catalog", func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Resource middlewares have access to the path values
+			if r.PathValue("id") == "secret" {
+				writeError(w, http.StatusUnauthorized, "Unauthorized")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	handler, err := addon.Handler()
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	tests := []struct {
+		path        string
+		status      int
+		middlewares []string
+	}{
+		{"/stream/movie/tt1254207.json", http.StatusOK, []string{"global1", "global2", "stream"}},
+		{"/manifest.json", http.StatusOK, []string{"global1", "global2", "manifest"}},
+		{"/foo/manifest.json", http.StatusOK, []string{"global1", "global2", "manifest"}},
+		{"/catalog/movie/foo.json", http.StatusOK, []string{"global1", "global2"}},
+		{"/catalog/movie/secret.json", http.StatusUnauthorized, []string{"global1", "global2"}},
+		{"/health", http.StatusOK, []string{"global1", "global2"}},
+		// Resource middlewares run before the validation
+		{"/stream/series/tt1254207.json", http.StatusBadRequest, []string{"global1", "global2", "stream"}},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(server.URL + test.path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, test.status, resp.StatusCode, test.path)
+		require.Equal(t, test.middlewares, resp.Header.Values("X-Middlewares"), test.path)
+	}
+
+	t.Run("unknown resource", func(t *testing.T) {
+		addon, err := NewAddon(manifest, catalogHandlers, nil, Options{})
+		require.NoError(t, err)
+		addon.UseFor("streams", record("streams"))
+		_, err = addon.Handler()
+		require.Error(t, err)
+	})
+}
+
+func TestResponseCache(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+		Catalogs: []CatalogItem{
+			{
+				Type: "movie",
+				ID:   "top",
+				Name: "Top movies",
+				Extra: []ExtraItem{
+					{Name: "genre"},
+					{Name: "skip"},
+				},
+			},
+		},
+	}
+
+	var catalogCalls, streamCalls int
+	catalogHandlers := map[string]CatalogHandler{
+		"movie": func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error) {
+			catalogCalls++
+			return []MetaPreviewItem{{ID: "tt1254207", Type: "movie", Name: "Big Buck Bunny"}}, nil
+		},
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			streamCalls++
+			if id == "tt0000000" {
+				return nil, errors.New("upstream error")
+			}
+			return []StreamItem{{URL: "https://example.com/" + id}}, nil
+		},
+	}
+
+	cache := NewLRUResponseCache(10)
+	opts := Options{
+		CacheAgeCatalogs:    time.Hour,
+		CacheAgeStreams:     time.Hour,
+		ServerCacheCatalogs: true,
+		ServerCacheStreams:  true,
+		ServerCache:         cache,
+	}
+	addon, err := NewAddon(manifest, catalogHandlers, streamHandlers, opts)
+	require.NoError(t, err)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(t *testing.T, path string) string {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return strconv.Itoa(resp.StatusCode) + " " + string(body)
+	}
+
+	t.Run("catalog", func(t *testing.T) {
+		first := get(t, "/catalog/movie/top/genre=Action&skip=100.json")
+		require.Equal(t, 1, catalogCalls)
+		// The order of the extra arguments doesn't matter
+		require.Equal(t, first, get(t, "/catalog/movie/top/skip=100&genre=Action.json"))
+		require.Equal(t, 1, catalogCalls)
+
+		get(t, "/catalog/movie/top/genre=Action&skip=200.json")
+		require.Equal(t, 2, catalogCalls)
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		first := get(t, "/stream/movie/tt1254207.json")
+		require.Equal(t, 1, streamCalls)
+		require.Equal(t, first, get(t, "/stream/movie/tt1254207.json"))
+		require.Equal(t, 1, streamCalls)
+
+		// Responses for other user data are cached separately
+		get(t, "/foo/stream/movie/tt1254207.json")
+		require.Equal(t, 2, streamCalls)
+		get(t, "/foo/stream/movie/tt1254207.json")
+		require.Equal(t, 2, streamCalls)
+	})
+
+	t.Run("errors aren't cached", func(t *testing.T) {
+		streamCalls = 0
+		get(t, "/stream/movie/tt0000000.json")
+		get(t, "/stream/movie/tt0000000.json")
+		require.Equal(t, 2, streamCalls)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		streamCalls = 0
+		get(t, "/stream/movie/tt0944947.json")
+		key := responseCacheKey("stream", "movie", "tt0944947", nil, "")
+		cached, found, err := cache.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		cached.Created = cached.Created.Add(-2 * time.Hour)
+		require.NoError(t, cache.Set(key, cached))
+
+		get(t, "/stream/movie/tt0944947.json")
+		require.Equal(t, 2, streamCalls)
+	})
+
+	t.Run("LRU eviction", func(t *testing.T) {
+		cache := NewLRUResponseCache(2)
+		require.NoError(t, cache.Set("a", CachedResponse{Body: []byte("a")}))
+		require.NoError(t, cache.Set("b", CachedResponse{Body: []byte("b")}))
+		// Use "a" so that "b" is the least recently used entry
+		_, found, _ := cache.Get("a")
+		require.True(t, found)
+		require.NoError(t, cache.Set("c", CachedResponse{Body: []byte("c")}))
+
+		require.Equal(t, 2, cache.Len())
+		_, found, _ = cache.Get("b")
+		require.False(t, found)
+		_, found, _ = cache.Get("a")
+		require.True(t, found)
+		_, found, _ = cache.Get("c")
+		require.True(t, found)
+	})
+
+	t.Run("cache age required", func(t *testing.T) {
+		_, err := NewAddon(manifest, catalogHandlers, nil, Options{ServerCacheCatalogs: true})
+		require.Error(t, err)
+	})
+}
+
+func TestCoalescing(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			if calls.Add(1) == 1 {
+				close(started)
+			}
+			<-release
+			return []StreamItem{{URL: "https://example.com/" + id}}, nil
+		},
+	}
+
+	addon, err := NewAddon(manifest, nil, streamHandlers, Options{CoalesceStreams: true, Metrics: true, DisableRequestLogging: true})
+	require.NoError(t, err)
+	handler, err := addon.Handler()
+	require.NoError(t, err)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	coalesced := metrics.GetOrCreateCounter(`coalesced_requests_total{resource="stream"}`)
+	coalescedBefore := coalesced.Get()
+
+	const requests = 10
+	bodies := make(chan string, requests)
+	get := func() {
+		resp, err := http.Get(server.URL + "/stream/movie/tt1254207.json")
+		if err != nil {
+			bodies <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		bodies <- strconv.Itoa(resp.StatusCode) + " " + string(body)
+	}
+
+	go get()
+	<-started
+	for range requests - 1 {
+		go get()
+	}
+	// Give the other requests time to arrive and wait for the first one
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	first := <-bodies
+	require.Contains(t, first, "200 ")
+	for range requests - 1 {
+		require.Equal(t, first, <-bodies)
+	}
+	require.EqualValues(t, 1, calls.Load())
+	require.EqualValues(t, requests-1, coalesced.Get()-coalescedBefore)
+
+	// Later requests call the handler again
+	get()
+	require.Equal(t, first, <-bodies)
+	require.EqualValues(t, 2, calls.Load())
+}
+
+func TestCoalescingPanic(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+
+	var calls atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			if calls.Add(1) == 1 {
+				close(started)
+			}
+			<-release
+			panic("boom")
+		},
+	}
+
+	addon, err := NewAddon(manifest, nil, streamHandlers, Options{CoalesceStreams: true, DisableRequestLogging: true})
+	require.NoError(t, err)
+	handler, err := addon.Handler()
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(handler)
+	// net/http logs the recovered panic of the first request
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.Start()
+	defer server.Close()
+
+	const requests = 5
+	results := make(chan string, requests)
+	get := func() {
+		resp, err := http.Get(server.URL + "/stream/movie/tt1254207.json")
+		if err != nil {
+			results <- "error"
+			return
+		}
+		defer resp.Body.Close()
+		results <- strconv.Itoa(resp.StatusCode)
+	}
+
+	go get()
+	<-started
+	for range requests - 1 {
+		go get()
+	}
+	// Give the other requests time to arrive and wait for the first one
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	// The first request's connection is aborted by net/http, the waiting ones get an error response instead of an empty 200
+	var statuses []string
+	for range requests {
+		statuses = append(statuses, <-results)
+	}
+	require.ElementsMatch(t, []string{"error", "500", "500", "500", "500"}, statuses)
+	require.EqualValues(t, 1, calls.Load())
+}
+
+func TestStaleResponses(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+
+	// The handler returns the current version as stream title, or an error if failing is set
+	var version atomic.Int32
+	var failing atomic.Bool
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			if failing.Load() {
+				return nil, errors.New("upstream error")
+			}
+			return []StreamItem{{URL: "https://example.com/" + id, Title: strconv.Itoa(int(version.Load()))}}, nil
+		},
+	}
+
+	cache := NewLRUResponseCache(10)
+	opts := Options{
+		CacheAgeStreams:        time.Hour,
+		ServerCacheStreams:     true,
+		ServerCache:            cache,
+		StaleRevalidateStreams: time.Hour,
+		StaleErrorStreams:      24 * time.Hour,
+	}
+	addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+	require.NoError(t, err)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// getTitle returns the status, the stream title and the age in seconds from the Age header, which is -1 if there's none
+	getTitle := func(t *testing.T, id string) (int, string, int) {
+		resp, err := http.Get(server.URL + "/stream/movie/" + id + ".json")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return resp.StatusCode, "", -1
+		}
+		age := -1
+		if ageHeader := resp.Header.Get("Age"); ageHeader != "" {
+			age, err = strconv.Atoi(ageHeader)
+			require.NoError(t, err)
+		}
+		require.Equal(t, "max-age=3600, stale-while-revalidate=3600, stale-if-error=86400", resp.Header.Get("Cache-Control"))
+		var result struct {
+			Streams []StreamItem `json:"streams"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+		return resp.StatusCode, result.Streams[0].Title, age
+	}
+	// age makes the cached response for the ID older
+	age := func(t *testing.T, id string, d time.Duration) {
+		key := responseCacheKey("stream", "movie", id, nil, "")
+		cached, found, err := cache.Get(key)
+		require.NoError(t, err)
+		require.True(t, found)
+		cached.Created = cached.Created.Add(-d)
+		require.NoError(t, cache.Set(key, cached))
+	}
+
+	t.Run("stale while revalidate", func(t *testing.T) {
+		version.Store(1)
+		status, title, responseAge := getTitle(t, "tt1254207")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "1", title)
+		// Responses from the handler have no Age header, cached ones have their age
+		require.Equal(t, -1, responseAge)
+		age(t, "tt1254207", 10*time.Minute)
+		_, title, responseAge = getTitle(t, "tt1254207")
+		require.Equal(t, "1", title)
+		require.InDelta(t, 600, responseAge, 1)
+
+		version.Store(2)
+		age(t, "tt1254207", 80*time.Minute)
+		// The stale response is served immediately and refreshed in the background.
+		// Its age is beyond the max-age, so clients and CDNs know that it's stale.
+		_, title, responseAge = getTitle(t, "tt1254207")
+		require.Equal(t, "1", title)
+		require.InDelta(t, 5400, responseAge, 1)
+		require.Eventually(t, func() bool {
+			_, title, _ := getTitle(t, "tt1254207")
+			return title == "2"
+		}, time.Second, 10*time.Millisecond)
+
+		// Beyond the stale-while-revalidate window the handler is called directly
+		version.Store(3)
+		age(t, "tt1254207", 3*time.Hour)
+		_, title, responseAge = getTitle(t, "tt1254207")
+		require.Equal(t, "3", title)
+		require.Equal(t, -1, responseAge)
+	})
+
+	t.Run("stale if error", func(t *testing.T) {
+		version.Store(1)
+		_, title, _ := getTitle(t, "tt0944947")
+		require.Equal(t, "1", title)
+
+		failing.Store(true)
+		defer failing.Store(false)
+		age(t, "tt0944947", 3*time.Hour)
+		status, title, responseAge := getTitle(t, "tt0944947")
+		require.Equal(t, http.StatusOK, status)
+		require.Equal(t, "1", title)
+		require.InDelta(t, 10800, responseAge, 1)
+
+		// Beyond the stale-if-error window the error is returned
+		age(t, "tt0944947", 24*time.Hour)
+		status, _, _ = getTitle(t, "tt0944947")
+		require.Equal(t, http.StatusInternalServerError, status)
+	})
+
+	t.Run("cache age required", func(t *testing.T) {
+		_, err := NewAddon(manifest, nil, streamHandlers, Options{StaleErrorStreams: time.Hour})
+		require.Error(t, err)
+	})
+}
+
+func TestConditionalRequests(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			return []StreamItem{{URL: "https://example.com/" + id}}, nil
+		},
+	}
+	opts := Options{
+		CacheAgeStreams:    time.Hour,
+		CachePublicStreams: true,
+		HandleEtagStreams:  true,
+		ServerCacheStreams: true,
+	}
+	addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+	require.NoError(t, err)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(t *testing.T, path string, header http.Header) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		require.NoError(t, err)
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get(t, "/stream/movie/tt1254207.json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "public, max-age=3600", resp.Header.Get("Cache-Control"))
+	etag := resp.Header.Get("ETag")
+	require.Regexp(t, `^"[0-9a-f]{64}"$`, etag)
+	lastModified := resp.Header.Get("Last-Modified")
+	lastModifiedTime, err := http.ParseTime(lastModified)
+	require.NoError(t, err)
+
+	// The same body for other user data has another ETag
+	resp = get(t, "/foo/stream/movie/tt1254207.json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, etag, resp.Header.Get("ETag"))
+
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+	}{
+		{"matching ETag", http.Header{"If-None-Match": {etag}}, http.StatusNotModified},
+		{"ETag list", http.Header{"If-None-Match": {`"foo", ` + etag}}, http.StatusNotModified},
+		{"weak ETag", http.Header{"If-None-Match": {"W/" + etag}}, http.StatusNotModified},
+		{"any ETag", http.Header{"If-None-Match": {"*"}}, http.StatusNotModified},
+		{"other ETag", http.Header{"If-None-Match": {`"foo"`}}, http.StatusOK},
+		{"not modified since", http.Header{"If-Modified-Since": {lastModified}}, http.StatusNotModified},
+		{"modified since", http.Header{"If-Modified-Since": {lastModifiedTime.Add(-time.Minute).Format(http.TimeFormat)}}, http.StatusOK},
+		// If-Modified-Since is ignored when If-None-Match is present
+		{"other ETag and not modified since", http.Header{"If-None-Match": {`"foo"`}, "If-Modified-Since": {lastModified}}, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := get(t, "/stream/movie/tt1254207.json", test.header)
+			require.Equal(t, test.status, resp.StatusCode)
+			require.Equal(t, etag, resp.Header.Get("ETag"))
+			require.Equal(t, "public, max-age=3600", resp.Header.Get("Cache-Control"))
+		})
+	}
+}
+
+// failingMetaFetcher is a MetaFetcher that always returns an error.
+type failingMetaFetcher struct{}
+
+func (failingMetaFetcher) GetMovie(ctx context.Context, imdbID string) (cinemeta.Meta, error) {
+	return cinemeta.Meta{}, cinemeta.ErrCircuitOpen
+}
+
+func (failingMetaFetcher) GetTVShow(ctx context.Context, imdbID string, season int, episode int) (cinemeta.Meta, error) {
+	return cinemeta.Meta{}, cinemeta.ErrCircuitOpen
+}
+
+func TestContinueWithoutMeta(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			_, err := cinemeta.GetMetaFromContext(ctx)
+			if !errors.Is(err, cinemeta.ErrNoMeta) {
+				return nil, errors.New("expected no meta in context")
+			}
+			return []StreamItem{{URL: "https://example.com/" + id}}, nil
+		},
+	}
+
+	for _, continueWithoutMeta := range []bool{false, true} {
+		opts := Options{
+			MetaClient:          failingMetaFetcher{},
+			PutMetaInContext:    true,
+			ContinueWithoutMeta: continueWithoutMeta,
+		}
+		addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+		require.NoError(t, err)
+		mux, err := addon.createMux()
+		require.NoError(t, err)
+		server := httptest.NewServer(mux)
+
+		resp, err := http.Get(server.URL + "/stream/movie/tt1254207.json")
+		require.NoError(t, err)
+		resp.Body.Close()
+		if continueWithoutMeta {
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+		} else {
+			require.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		}
+		server.Close()
+	}
+}
+
+// stubMetaFetcher is a MetaFetcher that returns meta with the requested IDs as name.
+type stubMetaFetcher struct{}
+
+func (stubMetaFetcher) GetMovie(ctx context.Context, imdbID string) (cinemeta.Meta, error) {
+	return cinemeta.Meta{ID: imdbID, Name: "Movie " + imdbID, ReleaseInfo: "2008"}, nil
+}
+
+func (stubMetaFetcher) GetTVShow(ctx context.Context, imdbID string, season int, episode int) (cinemeta.Meta, error) {
+	return cinemeta.Meta{
+		ID:          imdbID,
+		Name:        "Show " + imdbID,
+		ReleaseInfo: "2011-2019",
+		Episode:     &cinemeta.Video{Season: season, Episode: episode},
+	}, nil
+}
+
+func TestMetaInContext(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie", "series"},
+	}
+	streamHandler := func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+		meta, ok := cinemeta.FromContext(ctx)
+		if !ok {
+			return []StreamItem{{Title: "no meta"}}, nil
+		}
+		return []StreamItem{{Title: meta.Name}}, nil
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie":  streamHandler,
+		"series": streamHandler,
+	}
+	opts := Options{
+		MetaClient:       stubMetaFetcher{},
+		PutMetaInContext: true,
+	}
+	addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+	require.NoError(t, err)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+		expectedTitle  string
+	}{
+		{"movie", "/stream/movie/tt1254207.json", http.StatusOK, "Movie tt1254207"},
+		{"episode", "/stream/series/tt0944947:1:2.json", http.StatusOK, "Show tt0944947"},
+		{"non-IMDb ID", "/stream/movie/kitsu:123.json", http.StatusOK, "no meta"},
+		{"TV show without episode", "/stream/series/tt0944947.json", http.StatusOK, "Show tt0944947"},
+		{"episode without episode number", "/stream/series/tt0944947:1.json", http.StatusBadRequest, ""},
+		{"invalid episode", "/stream/series/tt0944947:1:x.json", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			if tt.expectedStatus != http.StatusOK {
+				return
+			}
+			var body struct {
+				Streams []StreamItem `json:"streams"`
+			}
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+			require.Len(t, body.Streams, 1)
+			require.Equal(t, tt.expectedTitle, body.Streams[0].Title)
+		})
+	}
+}
+
+// syncBuffer is a bytes.Buffer that can be written to by loggers in other goroutines while the test reads it.
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+// mediaNames returns the media names of all log entries that contain one.
+func (b *syncBuffer) mediaNames(t *testing.T) []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var mediaNames []string
+	decoder := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for decoder.More() {
+		var entry struct {
+			MediaName string `json:"mediaName"`
+		}
+		require.NoError(t, decoder.Decode(&entry))
+		if entry.MediaName != "" {
+			mediaNames = append(mediaNames, entry.MediaName)
+		}
+	}
+	return mediaNames
+}
+
+// slowMetaProvider is a MetaProvider that responds after the delay.
+type slowMetaProvider struct {
+	MetaProvider
+	delay time.Duration
+}
+
+func (p slowMetaProvider) GetMeta(ctx context.Context, t, id string) (MediaMeta, error) {
+	time.Sleep(p.delay)
+	return p.MetaProvider.GetMeta(ctx, t, id)
+}
+
+func TestLogMediaName(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie", "series"},
+	}
+	streamHandler := func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+		// Without PutMetaInContext the meta is only fetched for logging
+		if _, ok := cinemeta.FromContext(ctx); ok {
+			return nil, errors.New("expected no meta in context")
+		}
+		return []StreamItem{{URL: "https://example.com/" + id}}, nil
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie":  streamHandler,
+		"series": streamHandler,
+	}
+	newServer := func(t *testing.T, logs *syncBuffer, metaProvider MetaProvider) *httptest.Server {
+		opts := Options{
+			Logger:       slog.New(slog.NewJSONHandler(logs, nil)),
+			MetaProvider: metaProvider,
+			LogMediaName: true,
+		}
+		addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+		require.NoError(t, err)
+		handler, err := addon.Handler()
+		require.NoError(t, err)
+		server := httptest.NewServer(handler)
+		t.Cleanup(server.Close)
+		return server
+	}
+
+	t.Run("media names", func(t *testing.T) {
+		tests := []struct {
+			path              string
+			expectedMediaName string
+		}{
+			{"/stream/movie/tt1254207.json", "Movie tt1254207 (2008)"},
+			{"/stream/series/tt0944947:1:2.json", "Show tt0944947 S01E02 (2011-2019)"},
+		}
+		for _, tt := range tests {
+			logs := &syncBuffer{}
+			server := newServer(t, logs, NewCinemetaProvider(stubMetaFetcher{}))
+			resp, err := http.Get(server.URL + tt.path)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, http.StatusOK, resp.StatusCode)
+
+			// Depending on whether the lookup or the handler finished first, the name is in the request's entry or in its own
+			require.Eventually(t, func() bool {
+				return slices.Contains(logs.mediaNames(t), tt.expectedMediaName)
+			}, time.Second, 10*time.Millisecond)
+		}
+	})
+
+	t.Run("slow lookup doesn't delay the response", func(t *testing.T) {
+		logs := &syncBuffer{}
+		server := newServer(t, logs, slowMetaProvider{NewCinemetaProvider(stubMetaFetcher{}), 500 * time.Millisecond})
+		start := time.Now()
+		resp, err := http.Get(server.URL + "/stream/movie/tt1254207.json")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Less(t, time.Since(start), 500*time.Millisecond)
+
+		// The request's entry doesn't know the name yet, a later entry does
+		require.Eventually(t, func() bool {
+			return slices.Equal([]string{"?", "Movie tt1254207 (2008)"}, logs.mediaNames(t))
+		}, 2*time.Second, 10*time.Millisecond)
+	})
+}
+
+// enrichmentMetaProvider is a MetaProvider for enrichment tests.
+// It doesn't know the ID "unknown", doesn't respond for the ID "slow" until the context is done
+// and records the requested IDs and the maximum number of concurrent requests.
+type enrichmentMetaProvider struct {
+	requested     sync.Map
+	current       atomic.Int64
+	maxConcurrent atomic.Int64
+}
+
+func (p *enrichmentMetaProvider) GetMeta(ctx context.Context, t, id string) (MediaMeta, error) {
+	p.requested.Store(id, true)
+	current := p.current.Add(1)
+	defer p.current.Add(-1)
+	for {
+		maxConcurrent := p.maxConcurrent.Load()
+		if current <= maxConcurrent || p.maxConcurrent.CompareAndSwap(maxConcurrent, current) {
+			break
+		}
+	}
+	// Give other requests the chance to run concurrently
+	time.Sleep(10 * time.Millisecond)
+
+	switch id {
+	case "unknown":
+		return MediaMeta{}, ErrNotFound
+	case "slow":
+		<-ctx.Done()
+		return MediaMeta{}, ctx.Err()
+	}
+	return MediaMeta{
+		MetaItem: MetaItem{
+			ID:          id,
+			Type:        t,
+			Name:        "Name " + id,
+			Poster:      "https://example.com/" + id + ".jpg",
+			Genres:      []string{"Drama"},
+			IMDbRating:  "7.5",
+			ReleaseInfo: "2008",
+			Description: "Description " + id,
+		},
+	}, nil
+}
+
+func TestCatalogEnrichment(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+		Catalogs: []CatalogItem{
+			{Type: "movie", ID: "popular", Name: "Popular"},
+		},
+	}
+	complete := MetaPreviewItem{
+		ID:          "complete",
+		Type:        "movie",
+		Name:        "Complete",
+		Poster:      "https://example.com/complete.jpg",
+		Genres:      []string{"Comedy"},
+		IMDbRating:  "8.0",
+		ReleaseInfo: "2010",
+		Description: "Complete description",
+	}
+	catalogHandlers := map[string]CatalogHandler{
+		"movie": func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error) {
+			return []MetaPreviewItem{
+				{ID: "tt1", Name: "Own name"},
+				{ID: "unknown"},
+				{ID: "tt2", Poster: "https://example.com/own.jpg"},
+				complete,
+				{ID: "slow"},
+				{ID: "tt3"},
+			}, nil
+		},
+	}
+
+	tests := []struct {
+		policy      EnrichmentPolicy
+		expectedIDs []string
+	}{
+		{EnrichmentKeepSparse, []string{"tt1", "unknown", "tt2", "complete", "slow", "tt3"}},
+		{EnrichmentDrop, []string{"tt1", "tt2", "complete", "tt3"}},
+	}
+	for _, tt := range tests {
+		provider := &enrichmentMetaProvider{}
+		opts := Options{
+			MetaProvider:      provider,
+			EnrichCatalogs:    true,
+			EnrichConcurrency: 2,
+			EnrichTimeout:     50 * time.Millisecond,
+			EnrichPolicy:      tt.policy,
+		}
+		addon, err := NewAddon(manifest, catalogHandlers, nil, opts)
+		require.NoError(t, err)
+		mux, err := addon.createMux()
+		require.NoError(t, err)
+		server := httptest.NewServer(mux)
+
+		resp, err := http.Get(server.URL + "/catalog/movie/popular.json")
+		require.NoError(t, err)
+		var body struct {
+			Metas []MetaPreviewItem `json:"metas"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		server.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var ids []string
+		metas := map[string]MetaPreviewItem{}
+		for _, meta := range body.Metas {
+			ids = append(ids, meta.ID)
+			metas[meta.ID] = meta
+		}
+		require.Equal(t, tt.expectedIDs, ids)
+
+		// Missing fields are filled, existing ones are kept
+		require.Equal(t, "Own name", metas["tt1"].Name)
+		require.Equal(t, "https://example.com/tt1.jpg", metas["tt1"].Poster)
+		require.Equal(t, "movie", metas["tt1"].Type)
+		require.Equal(t, "Name tt2", metas["tt2"].Name)
+		require.Equal(t, "https://example.com/own.jpg", metas["tt2"].Poster)
+		require.Equal(t, []string{"Drama"}, metas["tt3"].Genres)
+		require.Equal(t, complete, metas["complete"])
+		if tt.policy == EnrichmentKeepSparse {
+			require.Equal(t, MetaPreviewItem{ID: "unknown"}, metas["unknown"])
+		}
+
+		// Complete items aren't enriched and the concurrency is bounded
+		_, requestedComplete := provider.requested.Load("complete")
+		require.False(t, requestedComplete)
+		require.LessOrEqual(t, provider.maxConcurrent.Load(), int64(2))
+	}
+
+	// A policy without enrichment doesn't make sense
+	_, err := NewAddon(manifest, catalogHandlers, nil, Options{EnrichPolicy: EnrichmentDrop})
+	require.Error(t, err)
+}
+
+func TestSeriesCatalogEnrichment(t *testing.T) {
+	// Cinemeta stand-in that only knows a TV show
+	var requests atomic.Int64
+	cinemetaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/meta/series/tt0944947.json" {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, `{"meta":{"id":"tt0944947","type":"series","name":"Game of Thrones","releaseInfo":"2011-2019",`+
+			`"poster":"https://example.com/got.jpg","videos":[{"id":"tt0944947:1:1","name":"Winter Is Coming","season":1,"episode":1}]}}`)
+	}))
+	defer cinemetaServer.Close()
+	metaClient := cinemeta.NewClient(cinemeta.ClientOptions{BaseURL: cinemetaServer.URL}, nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	defer metaClient.Close()
+
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"series"},
+		Catalogs: []CatalogItem{
+			{Type: "series", ID: "popular", Name: "Popular"},
+		},
+	}
+	catalogHandlers := map[string]CatalogHandler{
+		"series": func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error) {
+			return []MetaPreviewItem{{ID: "tt0944947"}}, nil
+		},
+	}
+	opts := Options{
+		MetaClient:     metaClient,
+		EnrichCatalogs: true,
+		EnrichPolicy:   EnrichmentDrop,
+	}
+	addon, err := NewAddon(manifest, catalogHandlers, nil, opts)
+	require.NoError(t, err)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/catalog/series/popular.json")
+	require.NoError(t, err)
+	var body struct {
+		Metas []MetaPreviewItem `json:"metas"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The TV show ID doesn't have a season and episode, but the item is enriched and not dropped
+	require.Len(t, body.Metas, 1)
+	require.Equal(t, "Game of Thrones", body.Metas[0].Name)
+	require.Equal(t, "series", body.Metas[0].Type)
+	require.Equal(t, "https://example.com/got.jpg", body.Metas[0].Poster)
+	require.Equal(t, "2011-2019", body.Metas[0].ReleaseInfo)
+	require.EqualValues(t, 1, requests.Load())
+}
+
+func TestHandlerErrors(t *testing.T) {
+	catalogIDs := []string{"notfound", "bad", "unavailable", "wrapped", "redirect", "other"}
+	var catalogs []CatalogItem
+	for _, id := range catalogIDs {
+		catalogs = append(catalogs, CatalogItem{Type: "movie", ID: id, Name: id})
+	}
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+		Catalogs:    catalogs,
+	}
+	secretErr := errors.New("secret upstream error")
+	catalogHandlers := map[string]CatalogHandler{
+		"movie": func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error) {
+			switch id {
+			case "notfound":
+				return nil, fmt.Errorf("no such catalog: %w", ErrNotFound)
+			case "bad":
+				return nil, fmt.Errorf("invalid genre: %w", ErrBadRequest)
+			case "unavailable":
+				return nil, &HandlerError{Status: http.StatusServiceUnavailable, Message: "Upstream unavailable", RetryAfter: 1500 * time.Millisecond, Err: secretErr}
+			case "wrapped":
+				return nil, fmt.Errorf("rate limited: %w", &HandlerError{Status: http.StatusTooManyRequests, Err: secretErr})
+			case "redirect":
+				return nil, &HandlerError{Status: http.StatusFound, Err: secretErr}
+			}
+			return nil, secretErr
+		},
+	}
+	manifestCallback := func(ctx context.Context, manifest *Manifest, userData any) int {
+		return http.StatusForbidden
+	}
+	addon, err := NewAddon(manifest, catalogHandlers, nil, Options{})
+	require.NoError(t, err)
+	addon.SetManifestCallback(manifestCallback)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		path               string
+		expectedStatus     int
+		expectedError      string
+		expectedRetryAfter string
+	}{
+		{"/catalog/movie/notfound.json", http.StatusNotFound, "Not found", ""},
+		{"/catalog/movie/bad.json", http.StatusBadRequest, "Bad request", ""},
+		{"/catalog/movie/unavailable.json", http.StatusServiceUnavailable, "Upstream unavailable", "2"},
+		{"/catalog/movie/wrapped.json", http.StatusTooManyRequests, "Too Many Requests", ""},
+		{"/catalog/movie/redirect.json", http.StatusInternalServerError, "Internal Server Error", ""},
+		{"/catalog/movie/other.json", http.StatusInternalServerError, "Failed to get catalog", ""},
+		{"/manifest.json", http.StatusForbidden, "Manifest callback returned error", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, err := http.Get(server.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+			require.Equal(t, tt.expectedRetryAfter, resp.Header.Get("Retry-After"))
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NotContains(t, string(body), secretErr.Error())
+			var errBody map[string]string
+			require.NoError(t, json.Unmarshal(body, &errBody))
+			require.Equal(t, tt.expectedError, errBody["error"])
+		})
+	}
+
+	// The cause can be checked with errors.Is()
+	handlerErr := &HandlerError{Status: http.StatusBadGateway, Err: secretErr}
+	require.ErrorIs(t, handlerErr, secretErr)
+	require.Equal(t, "502 Bad Gateway: secret upstream error", handlerErr.Error())
+}
+
+func TestEmptyResponses(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			switch id {
+			case "tt1":
+				return nil, ErrNotFound
+			case "tt2":
+				return nil, errors.New("upstream error")
+			case "tt3":
+				return nil, ErrBadRequest
+			}
+			return []StreamItem{{URL: "https://example.com/" + id}}, nil
+		},
+	}
+	metaHandlers := map[string]MetaHandler{
+		"movie": func(ctx context.Context, id string, userData any) (MetaItem, error) {
+			return MetaItem{}, ErrNotFound
+		},
+	}
+
+	tests := []struct {
+		name                 string
+		onError              bool
+		path                 string
+		expectedStatus       int
+		expectedBody         string
+		expectedCacheControl string
+	}{
+		{"not found", false, "/stream/movie/tt1.json", http.StatusOK, `{"cacheMaxAge":60,"staleError":3600,"streams":[]}`, "max-age=60, stale-if-error=3600"},
+		{"error", false, "/stream/movie/tt2.json", http.StatusInternalServerError, `{"error":"Failed to get stream"}`, ""},
+		{"error with OnError", true, "/stream/movie/tt2.json", http.StatusOK, `{"cacheMaxAge":60,"staleError":3600,"streams":[]}`, "max-age=60, stale-if-error=3600"},
+		{"bad request with OnError", true, "/stream/movie/tt3.json", http.StatusBadRequest, `{"error":"Bad request"}`, ""},
+		{"success", true, "/stream/movie/tt4.json", http.StatusOK, `{"streams":[{"url":"https://example.com/tt4"}]}`, "max-age=3600"},
+		{"meta", false, "/meta/movie/tt1.json", http.StatusOK, `{"meta":null}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := Options{
+				CacheAgeStreams: time.Hour,
+				EmptyResponses: map[string]*EmptyResponsePolicy{
+					"stream": {
+						OnError:     tt.onError,
+						CacheMaxAge: time.Minute,
+						StaleError:  time.Hour,
+					},
+					"meta": {},
+				},
+			}
+			addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+			require.NoError(t, err)
+			addon.SetMetaHandlers(metaHandlers)
+			mux, err := addon.createMux()
+			require.NoError(t, err)
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			resp, err := http.Get(server.URL + tt.path)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			require.Equal(t, tt.expectedStatus, resp.StatusCode)
+			require.Equal(t, tt.expectedCacheControl, resp.Header.Get("Cache-Control"))
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, tt.expectedBody, string(body))
+		})
+	}
+
+	// Empty manifests don't exist
+	opts := Options{
+		EmptyResponses: map[string]*EmptyResponsePolicy{"manifest": {}},
+	}
+	addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+	require.NoError(t, err)
+	_, err = addon.createMux()
+	require.Error(t, err)
+}
+
+func TestCacheHints(t *testing.T) {
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie"},
+	}
+	var calls atomic.Int64
+	streamHandlers := map[string]StreamHandler{
+		"movie": func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+			calls.Add(1)
+			if id != "tt2" {
+				SetCacheHints(ctx, CacheHints{CacheMaxAge: 5 * time.Minute, StaleRevalidate: time.Minute})
+			}
+			return []StreamItem{{URL: "https://example.com/" + id}}, nil
+		},
+	}
+	cache := NewLRUResponseCache(10)
+	opts := Options{
+		CacheAgeStreams:    time.Hour,
+		StaleErrorStreams:  24 * time.Hour,
+		ServerCacheStreams: true,
+		ServerCache:        cache,
+	}
+	addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+	require.NoError(t, err)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(id string) (string, string) {
+		resp, err := http.Get(server.URL + "/stream/movie/" + id + ".json")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body), resp.Header.Get("Cache-Control")
+	}
+
+	// The hints are in the body and the Cache-Control header, also when the response comes from the server-side cache
+	for range 2 {
+		body, cacheControl := get("tt1")
+		require.JSONEq(t, `{"streams":[{"url":"https://example.com/tt1"}],"cacheMaxAge":300,"staleRevalidate":60}`, body)
+		require.Equal(t, "max-age=300, stale-while-revalidate=60, stale-if-error=86400", cacheControl)
+	}
+	require.Equal(t, int64(1), calls.Load())
+
+	// Without hints the options apply
+	body, cacheControl := get("tt2")
+	require.JSONEq(t, `{"streams":[{"url":"https://example.com/tt2"}]}`, body)
+	require.Equal(t, "max-age=3600, stale-if-error=86400", cacheControl)
+
+	// The hints determine the freshness of cached responses
+	created := time.Now().Add(-10 * time.Minute)
+	err = cache.Set(responseCacheKey("stream", "movie", "tt3", nil, ""), CachedResponse{
+		Body:    []byte(`{"streams":[]}`),
+		Created: created,
+		Hints:   &CacheHints{CacheMaxAge: 5 * time.Minute},
+	})
+	require.NoError(t, err)
+	err = cache.Set(responseCacheKey("stream", "movie", "tt4", nil, ""), CachedResponse{
+		Body:    []byte(`{"streams":[]}`),
+		Created: created,
+	})
+	require.NoError(t, err)
+	calls.Store(0)
+	body, _ = get("tt3")
+	require.JSONEq(t, `{"streams":[{"url":"https://example.com/tt3"}],"cacheMaxAge":300,"staleRevalidate":60}`, body)
+	body, _ = get("tt4")
+	require.JSONEq(t, `{"streams":[]}`, body)
+	require.Equal(t, int64(1), calls.Load())
+
+	// Setting hints outside of a handler has no effect
+	SetCacheHints(context.Background(), CacheHints{CacheMaxAge: time.Minute})
+}
@@ -0,0 +1,92 @@
+package stremio
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// CacheHints are cache durations for a single response, which handlers can set with SetCacheHints().
+// The addon writes them as "cacheMaxAge", "staleRevalidate" and "staleError" fields into the JSON body, which Stremio's own cache honours,
+// and uses them for the Cache-Control header and the server-side cache instead of the durations in the options.
+// Zero durations keep the durations from the options.
+type CacheHints struct {
+	CacheMaxAge     time.Duration
+	StaleRevalidate time.Duration
+	StaleError      time.Duration
+}
+
+// cacheHintsKey is the context key for the *cacheHintsHolder.
+type cacheHintsKey struct{}
+
+// cacheHintsHolder holds the cache hints that a handler set.
+// The resource handler puts an empty one into the handler's context and reads it after the handler returned.
+type cacheHintsHolder struct {
+	hints *CacheHints
+	lock  *sync.Mutex
+}
+
+// SetCacheHints sets the cache hints for the response of a catalog, stream, meta, subtitles or addon catalog handler.
+// Call it with the context that the handler was called with, for example with a short CacheMaxAge for a stream list
+// that will soon contain more streams. Calling it again replaces the previous hints.
+// The hints are ignored if the handler returns an error, and calling it with another context has no effect.
+func SetCacheHints(ctx context.Context, hints CacheHints) {
+	holder, ok := ctx.Value(cacheHintsKey{}).(*cacheHintsHolder)
+	if !ok {
+		return
+	}
+	holder.lock.Lock()
+	defer holder.lock.Unlock()
+	holder.hints = &hints
+}
+
+// withCacheHintsHolder returns a copy of the parent context that contains an empty holder for cache hints, and the holder.
+func withCacheHintsHolder(ctx context.Context) (context.Context, *cacheHintsHolder) {
+	holder := &cacheHintsHolder{
+		lock: &sync.Mutex{},
+	}
+	return context.WithValue(ctx, cacheHintsKey{}, holder), holder
+}
+
+// get returns the cache hints that were set, or nil if none were set.
+func (h *cacheHintsHolder) get() *CacheHints {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.hints
+}
+
+// marshalResponse returns the JSON body of a resource response with the value under the given key,
+// and the non-zero cache hints in seconds, like {"streams":[...],"cacheMaxAge":3600}.
+func marshalResponse(key string, value any, hints *CacheHints) ([]byte, error) {
+	body := map[string]any{key: value}
+	if hints != nil {
+		if hints.CacheMaxAge > 0 {
+			body["cacheMaxAge"] = int(hints.CacheMaxAge.Seconds())
+		}
+		if hints.StaleRevalidate > 0 {
+			body["staleRevalidate"] = int(hints.StaleRevalidate.Seconds())
+		}
+		if hints.StaleError > 0 {
+			body["staleError"] = int(hints.StaleError.Seconds())
+		}
+	}
+	return json.Marshal(body)
+}
+
+// withHints returns a copy of the config with the non-zero durations of the cache hints.
+func (cfg resourceConfig) withHints(hints *CacheHints) resourceConfig {
+	if hints == nil {
+		return cfg
+	}
+	if hints.CacheMaxAge > 0 {
+		cfg.cacheAge = int(hints.CacheMaxAge.Seconds())
+	}
+	if hints.StaleRevalidate > 0 {
+		cfg.staleRevalidate = int(hints.StaleRevalidate.Seconds())
+	}
+	if hints.StaleError > 0 {
+		cfg.staleError = int(hints.StaleError.Seconds())
+	}
+	return cfg
+}
@@ -0,0 +1,85 @@
+package stremio
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generateETag generates a strong ETag like `"<sha256>"` for the given response body and user data.
+// The user data is included because responses for different user data are different representations, even if their bodies are equal.
+func generateETag(body []byte, userData string) string {
+	hash := sha256.New()
+	hash.Write(body)
+	hash.Write([]byte(userData))
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+}
+
+// etagMatches reports whether the value of an If-None-Match header matches the ETag.
+// The header can contain a list of ETags or "*". ETags are compared weakly, so `W/"foo"` matches `"foo"`, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl returns the value of the Cache-Control header for a resource response, like "public, max-age=3600".
+// It's empty if no cache age is configured.
+func cacheControl(cfg resourceConfig) string {
+	if cfg.cacheAge <= 0 {
+		return ""
+	}
+	var directives []string
+	if cfg.cachePublic {
+		directives = append(directives, "public")
+	}
+	directives = append(directives, "max-age="+strconv.Itoa(cfg.cacheAge))
+	if cfg.staleRevalidate > 0 {
+		directives = append(directives, "stale-while-revalidate="+strconv.Itoa(cfg.staleRevalidate))
+	}
+	if cfg.staleError > 0 {
+		directives = append(directives, "stale-if-error="+strconv.Itoa(cfg.staleError))
+	}
+	return strings.Join(directives, ", ")
+}
+
+// writeResponse writes the JSON body of a resource response with the cache headers from the config.
+// The modified time is the time the body was created, for the Last-Modified header.
+// With ETag handling enabled, conditional requests with a matching If-None-Match or If-Modified-Since header get a "304 Not Modified" response.
+func writeResponse(w http.ResponseWriter, r *http.Request, body []byte, modified time.Time, userData string, cfg resourceConfig) {
+	// Set cache headers
+	if cc := cacheControl(cfg); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+
+	// Handle conditional requests
+	if cfg.handleEtag {
+		etag := generateETag(body, userData)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+
+		// If-Modified-Since must be ignored when If-None-Match is present
+		if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+			if etagMatches(ifNoneMatch, etag) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		} else if ifModifiedSince, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+			// HTTP dates only have a precision of seconds
+			if !modified.Truncate(time.Second).After(ifModifiedSince) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
@@ -11,6 +11,12 @@ type Options struct {
 	// Server options
 	BindAddr string
 	Port     int
+	// Path prefix under which the addon is served, like "/my-addon".
+	// Useful when mounting several addons on one server with Handler().
+	PathPrefix string
+	// Grace period for finishing in-flight requests when shutting down the server.
+	// Default 10 seconds.
+	ShutdownTimeout time.Duration
 
 	// Logging options
 	Logger                *slog.Logger
@@ -22,39 +28,110 @@ type Options struct {
 	LogMediaName          bool
 
 	// Caching options
-	CacheAgeCatalogs time.Duration
-	CacheAgeStreams  time.Duration
-	// If true, the addon will send Cache-Control headers with the max-age set to CacheAgeCatalogs/Streams.
+	CacheAgeCatalogs  time.Duration
+	CacheAgeStreams   time.Duration
+	CacheAgeMeta      time.Duration
+	CacheAgeSubtitles time.Duration
+	// If true, the Cache-Control headers with the max-age set to CacheAgeCatalogs/Streams/Meta/Subtitles also contain the "public" directive.
 	// This is useful when you have a CDN in front of your addon.
-	CachePublicCatalogs bool
-	CachePublicStreams  bool
-	// If true, the addon will handle ETag headers for catalogs and streams.
+	CachePublicCatalogs  bool
+	CachePublicStreams   bool
+	CachePublicMeta      bool
+	CachePublicSubtitles bool
+	// If true, the addon will handle ETag headers for catalogs, streams, meta and subtitles.
+	// Responses get an ETag and a Last-Modified header and conditional requests with If-None-Match or If-Modified-Since get a "304 Not Modified" response.
 	// This is useful when you have a CDN in front of your addon.
-	HandleEtagCatalogs bool
-	HandleEtagStreams  bool
+	HandleEtagCatalogs  bool
+	HandleEtagStreams   bool
+	HandleEtagMeta      bool
+	HandleEtagSubtitles bool
+	// If true, the addon caches the responses of the catalog and stream handlers on the server side for CacheAgeCatalogs/Streams,
+	// so that handlers aren't called again for the same type, ID, extra arguments and user data.
+	ServerCacheCatalogs bool
+	ServerCacheStreams  bool
+	// Maximum number of responses in the server-side cache. When it's full, the least recently used response is evicted.
+	// Default 1000. Only used if ServerCache isn't set.
+	ServerCacheSize int
+	// Backend of the server-side cache, for example for a cache that's shared between multiple instances of your addon.
+	// Default is an in-memory LRUResponseCache with ServerCacheSize entries.
+	ServerCache ResponseCache
+	// Time after CacheAgeCatalogs/Streams during which a stale response may be served while it's refreshed in the background.
+	// The addon sends it as "stale-while-revalidate" Cache-Control directive and, with server-side caching enabled,
+	// serves stale responses from its cache immediately while calling the handler in the background.
+	StaleRevalidateCatalogs time.Duration
+	StaleRevalidateStreams  time.Duration
+	// Time after CacheAgeCatalogs/Streams during which a stale response may be served when the handler returns an error.
+	// The addon sends it as "stale-if-error" Cache-Control directive and, with server-side caching enabled,
+	// serves stale responses from its cache instead of an error response.
+	StaleErrorCatalogs time.Duration
+	StaleErrorStreams  time.Duration
+	// If true, identical catalog/stream requests (same type, ID, extra arguments and user data) that arrive while one of them is
+	// being handled wait for that one and get its response, instead of calling the handler again.
+	// This protects your upstream services when many users request the same new release at the same time.
+	CoalesceCatalogs bool
+	CoalesceStreams  bool
 
 	// Meta options
-	MetaClient       MetaFetcher
+	MetaClient MetaFetcher
+	// Provider for the meta of stream requests with IDs other than IMDb IDs, like a MetaRegistry with providers for "tt", "kitsu:" and "tmdb:" IDs.
+	// Can't be combined with MetaClient. If neither is set, a Cinemeta client is used.
+	MetaProvider     MetaProvider
 	CinemetaTimeout  time.Duration
 	PutMetaInContext bool
+	// If true, stream requests are passed to the stream handler even if the meta couldn't be fetched,
+	// for example because Cinemeta is down. The context then doesn't contain the meta.
+	// By default such requests fail with "500 Internal Server Error".
+	ContinueWithoutMeta bool
+	// If true, catalog items with missing fields (like Poster, Genres, IMDbRating or ReleaseInfo) are enriched with the meta
+	// from the MetaClient or MetaProvider (Cinemeta by default), so catalog handlers can return items with only ID and name.
+	// Only empty fields are filled.
+	EnrichCatalogs bool
+	// Maximum number of items of a catalog response that are enriched concurrently.
+	// Default 10.
+	EnrichConcurrency int
+	// Timeout for enriching a single catalog item.
+	// Default 2 seconds.
+	EnrichTimeout time.Duration
+	// What happens with catalog items that couldn't be enriched, for example because the meta provider doesn't know their ID.
+	// Default EnrichmentKeepSparse.
+	EnrichPolicy EnrichmentPolicy
 
 	// Configuration options
 	ConfigureHTMLfs http.FileSystem
 
 	// Other options
-	Metrics     bool
-	Profiling   bool
-	RedirectURL string
+	// If true, the addon collects metrics and exposes them in the Prometheus text format at "/metrics".
+	// Metrics include request counts and durations per endpoint and type, handler errors and Cinemeta cache hits and misses.
+	Metrics bool
+	// If true, the addon serves the net/http/pprof endpoints at "/debug/pprof/".
+	Profiling bool
+	// If set, the profiling endpoints are served on this separate address (like "localhost:6060") instead of the addon's address,
+	// so they're never exposed on the public addon port.
+	ProfilingAddr string
+	// If set, requests to the profiling endpoints must contain this token in an "Authorization: Bearer <token>" header.
+	ProfilingToken string
+	RedirectURL    string
 	// If true, the addon will expect user data to be base64 encoded.
 	UserDataIsBase64 bool
 	// If set, the addon will only handle stream requests with IDs matching this regex.
+	// It's a shorthand for IDregexes["stream"].
 	StreamIDregex string
+	// Regexes that the IDs of requests must match, keyed by resource name (like "meta" or "subtitles").
+	// Requests with other IDs are rejected with "400 Bad Request".
+	IDregexes map[string]string
+	// Policies for empty responses like {"streams": []} instead of error responses, keyed by resource name (like "stream" or "catalog").
+	// For example a stream addon can respond to ErrNotFound and handler errors with an empty list of streams and a short cache age.
+	EmptyResponses map[string]*EmptyResponsePolicy
 }
 
 // DefaultOptions contains the default values for Options.
 var DefaultOptions = Options{
-	BindAddr:     "0.0.0.0",
-	Port:         8080,
-	LoggingLevel: "info",
-	LogEncoding:  "console",
+	BindAddr:          "0.0.0.0",
+	Port:              8080,
+	ShutdownTimeout:   10 * time.Second,
+	ServerCacheSize:   1000,
+	EnrichConcurrency: 10,
+	EnrichTimeout:     2 * time.Second,
+	LoggingLevel:      "info",
+	LogEncoding:       "console",
 }
@@ -0,0 +1,39 @@
+package stremio
+
+import (
+	"time"
+)
+
+// EmptyResponsePolicy configures that a resource's handler errors lead to empty responses like {"streams": []} instead of error responses.
+// Stremio clients handle errors of addons poorly, while an empty result with a short cache age is the idiomatic "nothing here" answer.
+// ErrNotFound always leads to an empty response, other errors only if OnError is true.
+// Client errors like ErrBadRequest still lead to error responses.
+type EmptyResponsePolicy struct {
+	// If true, server errors (like handler errors other than ErrNotFound) lead to empty responses as well.
+	OnError bool
+	// Values of the "cacheMaxAge", "staleRevalidate" and "staleError" fields in the response body, which Stremio uses for caching,
+	// and of the corresponding Cache-Control directives. Zero values are omitted.
+	// Use short durations, so that clients ask again soon when for example an upstream service is back.
+	CacheMaxAge     time.Duration
+	StaleRevalidate time.Duration
+	StaleError      time.Duration
+}
+
+// cacheHints returns the policy's cache durations as CacheHints.
+func (p *EmptyResponsePolicy) cacheHints() *CacheHints {
+	return &CacheHints{
+		CacheMaxAge:     p.CacheMaxAge,
+		StaleRevalidate: p.StaleRevalidate,
+		StaleError:      p.StaleError,
+	}
+}
+
+// emptyResponseBody returns the body of an empty response, like {"streams":[],"cacheMaxAge":60}.
+// The key is the resource's key in the body, like "streams". For "meta" the value is null, for all others an empty list.
+func emptyResponseBody(key string, policy *EmptyResponsePolicy) ([]byte, error) {
+	var empty any = []struct{}{}
+	if key == "meta" {
+		empty = nil
+	}
+	return marshalResponse(key, empty, policy.cacheHints())
+}
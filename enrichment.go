@@ -0,0 +1,138 @@
+package stremio
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// EnrichmentPolicy determines what happens with catalog items that couldn't be enriched with meta,
+// for example because the meta provider doesn't know their ID or timed out.
+type EnrichmentPolicy int
+
+const (
+	// EnrichmentKeepSparse keeps items that couldn't be enriched as the catalog handler returned them.
+	EnrichmentKeepSparse EnrichmentPolicy = iota
+	// EnrichmentDrop removes items that couldn't be enriched from the catalog response.
+	EnrichmentDrop
+)
+
+// catalogEnricher fills missing fields of the MetaPreviewItems that catalog handlers return with meta from a MetaProvider.
+type catalogEnricher struct {
+	metaProvider MetaProvider
+	// Maximum number of items that are enriched concurrently
+	concurrency int
+	// Timeout for enriching a single item. <= 0 means no timeout.
+	timeout time.Duration
+	policy  EnrichmentPolicy
+	logger  *slog.Logger
+}
+
+// wrap returns a catalog handler that enriches the items that the given handler returns.
+// The type is used for items that don't have a type.
+func (e *catalogEnricher) wrap(handler CatalogHandler, t string) CatalogHandler {
+	return func(ctx context.Context, id string, extra CatalogExtra, userData any) ([]MetaPreviewItem, error) {
+		items, err := handler(ctx, id, extra, userData)
+		if err != nil {
+			return nil, err
+		}
+		return e.enrich(ctx, t, items), nil
+	}
+}
+
+// enrich fills the missing fields of the items concurrently and returns them in the original order.
+// Depending on the policy, items that couldn't be enriched are kept as they are or dropped.
+func (e *catalogEnricher) enrich(ctx context.Context, t string, items []MetaPreviewItem) []MetaPreviewItem {
+	enriched := make([]MetaPreviewItem, len(items))
+	failed := make([]bool, len(items))
+	semaphore := make(chan struct{}, max(e.concurrency, 1))
+	var wg sync.WaitGroup
+	for i, item := range items {
+		enriched[i] = item
+		if !needsEnrichment(item) {
+			continue
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func() {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			itemType := item.Type
+			if itemType == "" {
+				itemType = t
+			}
+			itemCtx := ctx
+			if e.timeout > 0 {
+				var cancel context.CancelFunc
+				itemCtx, cancel = context.WithTimeout(ctx, e.timeout)
+				defer cancel()
+			}
+			meta, err := e.metaProvider.GetMeta(itemCtx, itemType, item.ID)
+			if err != nil {
+				e.logger.Debug("Couldn't enrich catalog item", "error", err, "type", itemType, "id", item.ID)
+				failed[i] = true
+				return
+			}
+			fillMetaPreviewItem(&enriched[i], meta)
+		}()
+	}
+	wg.Wait()
+
+	var failedCount int
+	result := enriched[:0]
+	for i, item := range enriched {
+		if failed[i] {
+			failedCount++
+			if e.policy == EnrichmentDrop {
+				continue
+			}
+		}
+		result = append(result, item)
+	}
+	if failedCount > 0 {
+		e.logger.Warn("Couldn't enrich some catalog items", "type", t, "failed", failedCount, "total", len(items), "dropped", e.policy == EnrichmentDrop)
+	}
+	return result
+}
+
+// needsEnrichment returns true if an item lacks any of the fields that Stremio shows in catalogs.
+func needsEnrichment(item MetaPreviewItem) bool {
+	return item.Name == "" || item.Poster == "" || len(item.Genres) == 0 || item.IMDbRating == "" || item.ReleaseInfo == "" || item.Description == ""
+}
+
+// fillMetaPreviewItem sets the empty fields of the item to the values of the meta.
+func fillMetaPreviewItem(item *MetaPreviewItem, meta MediaMeta) {
+	fillString := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fillSlice := func(field *[]string, value []string) {
+		if len(*field) == 0 {
+			*field = value
+		}
+	}
+
+	fillString(&item.Type, meta.Type)
+	fillString(&item.Name, meta.Name)
+	fillString(&item.Poster, meta.Poster)
+	fillString(&item.PosterShape, meta.PosterShape)
+	fillSlice(&item.Genres, meta.Genres)
+	fillSlice(&item.Director, meta.Director)
+	fillSlice(&item.Cast, meta.Cast)
+	if len(item.Links) == 0 {
+		item.Links = meta.Links
+	}
+	fillString(&item.IMDbRating, meta.IMDbRating)
+	fillString(&item.ReleaseInfo, meta.ReleaseInfo)
+	fillString(&item.Description, meta.Description)
+	fillString(&item.Released, meta.Released)
+	fillString(&item.Runtime, meta.Runtime)
+	fillString(&item.Language, meta.Language)
+	fillString(&item.Country, meta.Country)
+	fillString(&item.Awards, meta.Awards)
+	fillString(&item.Website, meta.Website)
+}
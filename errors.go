@@ -2,6 +2,9 @@ package stremio
 
 import (
 	"errors"
+	"fmt"
+	"net/http"
+	"time"
 )
 
 var (
@@ -12,3 +15,71 @@ var (
 	// It leads to a "404 Not Found" response.
 	ErrNotFound = errors.New("not found")
 )
+
+// HandlerError is an error that handlers can return to control the error response.
+// The addon responds with the Status and a JSON body like {"error": "Upstream service unavailable"}.
+// Err is the internal cause. It's logged, but not sent to the client.
+// HandlerErrors can be wrapped, the addon finds them with errors.As().
+type HandlerError struct {
+	// HTTP status code of the response, like 503. Default 500, which is also used for status codes other than 4xx and 5xx.
+	Status int
+	// Message for the client. Default is the status text, like "Service Unavailable".
+	Message string
+	// If > 0, the response contains a Retry-After header with this duration in seconds, rounded up.
+	RetryAfter time.Duration
+	// Internal cause of the error
+	Err error
+}
+
+// Error returns the status, message and cause of the error.
+func (e *HandlerError) Error() string {
+	msg := fmt.Sprintf("%v %v", e.status(), e.message())
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+// Unwrap returns the cause of the error, so you can check it with errors.Is() and errors.As().
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// status returns the HTTP status code or 500 if none or no error status code is set.
+// Success and redirect status codes would make clients treat the error body as a valid response.
+func (e *HandlerError) status() int {
+	if e.Status < 400 || e.Status > 599 {
+		return http.StatusInternalServerError
+	}
+	return e.Status
+}
+
+// message returns the message or the status text if none is set.
+func (e *HandlerError) message() string {
+	if e.Message == "" {
+		return http.StatusText(e.status())
+	}
+	return e.Message
+}
+
+// toHandlerError translates an error that a handler returned to a HandlerError.
+// HandlerErrors are returned as they are, ErrBadRequest leads to a 400 status, ErrNotFound to a 404 status
+// and other errors to a 500 status with the given fallback message.
+func toHandlerError(err error, fallbackMessage string) *HandlerError {
+	var handlerErr *HandlerError
+	if errors.As(err, &handlerErr) {
+		return &HandlerError{
+			Status:     handlerErr.status(),
+			Message:    handlerErr.message(),
+			RetryAfter: handlerErr.RetryAfter,
+			Err:        err,
+		}
+	} else if errors.Is(err, errInvalidExtra) {
+		return &HandlerError{Status: http.StatusBadRequest, Message: err.Error(), Err: err}
+	} else if errors.Is(err, ErrBadRequest) {
+		return &HandlerError{Status: http.StatusBadRequest, Message: "Bad request", Err: err}
+	} else if errors.Is(err, ErrNotFound) {
+		return &HandlerError{Status: http.StatusNotFound, Message: "Not found", Err: err}
+	}
+	return &HandlerError{Status: http.StatusInternalServerError, Message: fallbackMessage, Err: err}
+}
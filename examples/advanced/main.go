@@ -129,7 +129,9 @@ func main() {
 		<-stoppingChan
 		logger.Info("Addon stopping")
 	}()
-	addon.Run(stoppingChan)
+	if err := addon.Run(stoppingChan); err != nil {
+		logger.Error("Couldn't run addon", "error", err)
+	}
 }
 
 func createMovieHandler(logger *slog.Logger) stremio.StreamHandler {
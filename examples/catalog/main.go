@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"strings"
 	"time"
 
 	"github.com/Dasio/go-stremio"
@@ -30,6 +31,25 @@ var (
 			Type: "movie",
 			ID:   "blender",
 			Name: "Free movies made with Blender",
+			// Allows users to search in the catalog
+			Extra: []stremio.ExtraItem{
+				{Name: "search"},
+			},
+		},
+	}
+
+	movies = []stremio.MetaPreviewItem{
+		{
+			ID:     "tt1254207",
+			Type:   "movie",
+			Name:   "Big Buck Bunny",
+			Poster: "https://upload.wikimedia.org/wikipedia/commons/thumb/c/c5/Big_buck_bunny_poster_big.jpg/339px-Big_buck_bunny_poster_big.jpg",
+		},
+		{
+			ID:     "tt1727587",
+			Type:   "movie",
+			Name:   "Sintel",
+			Poster: "https://images.metahub.space/poster/small/tt1727587/img",
 		},
 	}
 )
@@ -51,25 +71,23 @@ func main() {
 		panic(err)
 	}
 
-	addon.Run(nil)
+	if err := addon.Run(nil); err != nil {
+		panic(err)
+	}
 }
 
-func movieHandler(ctx context.Context, id string, userData any) ([]stremio.MetaPreviewItem, error) {
+func movieHandler(ctx context.Context, id string, extra stremio.CatalogExtra, userData any) ([]stremio.MetaPreviewItem, error) {
 	if id != "blender" {
 		return nil, stremio.ErrNotFound
 	}
-	return []stremio.MetaPreviewItem{
-		{
-			ID:     "tt1254207",
-			Type:   "movie",
-			Name:   "Big Buck Bunny",
-			Poster: "https://upload.wikimedia.org/wikipedia/commons/thumb/c/c5/Big_buck_bunny_poster_big.jpg/339px-Big_buck_bunny_poster_big.jpg",
-		},
-		{
-			ID:     "tt1727587",
-			Type:   "movie",
-			Name:   "Sintel",
-			Poster: "https://images.metahub.space/poster/small/tt1727587/img",
-		},
-	}, nil
+	if extra.Search == "" {
+		return movies, nil
+	}
+	var result []stremio.MetaPreviewItem
+	for _, movie := range movies {
+		if strings.Contains(strings.ToLower(movie.Name), strings.ToLower(extra.Search)) {
+			result = append(result, movie)
+		}
+	}
+	return result, nil
 }
@@ -26,6 +26,10 @@ func main() {
 					Name:  "catalog",
 					Types: []string{"movie", "series"},
 				},
+				{
+					Name:  "subtitles",
+					Types: []string{"movie"},
+				},
 			},
 			Types: []string{"movie", "series"},
 			Catalogs: []stremio.CatalogItem{
@@ -46,7 +50,7 @@ func main() {
 			},
 		},
 		map[string]stremio.CatalogHandler{
-			"movie": func(ctx context.Context, id string, userData any) ([]stremio.MetaPreviewItem, error) {
+			"movie": func(ctx context.Context, id string, extra stremio.CatalogExtra, userData any) ([]stremio.MetaPreviewItem, error) {
 				// Example catalog handler for movies
 				return []stremio.MetaPreviewItem{
 					{
@@ -127,26 +131,31 @@ func main() {
 		}, nil
 	})
 
-	// Set up subtitle handler
-	addon.AddSubtitleHandler(func(ctx context.Context, videoID string, userData any) ([]stremio.SubtitleItem, error) {
-		// Example subtitle handler
-		return []stremio.SubtitleItem{
-			{
-				ID:       "en",
-				URL:      "https://example.com/subtitles/en.srt",
-				Language: "en",
-				Label:    "English",
-			},
-			{
-				ID:       "es",
-				URL:      "https://example.com/subtitles/es.srt",
-				Language: "es",
-				Label:    "Spanish",
-			},
-		}, nil
+	// Set up subtitles handler
+	addon.SetSubtitleHandlers(map[string]stremio.SubtitleHandler{
+		"movie": func(ctx context.Context, id string, extra stremio.SubtitleExtra, userData any) ([]stremio.SubtitleItem, error) {
+			// Example subtitles handler
+			return []stremio.SubtitleItem{
+				{
+					ID:       "en",
+					URL:      "https://example.com/subtitles/en.srt",
+					Language: "en",
+					Label:    "English",
+				},
+				{
+					ID:       "es",
+					URL:      "https://example.com/subtitles/es.srt",
+					Language: "es",
+					Label:    "Spanish",
+				},
+			}, nil
+		},
 	})
 
 	// Run the addon
 	stoppingChan := make(chan bool, 1)
-	addon.Run(stoppingChan)
+	if err := addon.Run(stoppingChan); err != nil {
+		slog.Error("Failed to run addon", "error", err)
+		os.Exit(1)
+	}
 }
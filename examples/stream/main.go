@@ -50,7 +50,9 @@ func main() {
 		panic(err)
 	}
 
-	addon.Run(nil)
+	if err := addon.Run(nil); err != nil {
+		panic(err)
+	}
 }
 
 func movieHandler(ctx context.Context, id string, userData any) ([]stremio.StreamItem, error) {
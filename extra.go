@@ -0,0 +1,94 @@
+package stremio
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+)
+
+// CatalogExtra contains the "extra" arguments of a catalog request, like the search query or the number of items to skip.
+// Stremio only sends the ones that you declared in the ExtraItems of the CatalogItem in the Manifest.
+// See https://github.com/Stremio/stremio-addon-sdk/blob/f6f1f2a8b627b9d4f2c62b003b251d98adadbebe/docs/api/requests/defineCatalogHandler.md
+type CatalogExtra struct {
+	// Search query, if the catalog declared the "search" extra
+	Search string
+	// Number of items to skip for pagination, if the catalog declared the "skip" extra
+	Skip int
+	// Selected genre, if the catalog declared the "genre" extra
+	Genre string
+
+	// All extra arguments including the ones above, for example for accessing custom extras
+	// or extras with multiple values (see ExtraItem.OptionsLimit).
+	// It's nil if the request didn't contain any extra arguments.
+	Values url.Values
+}
+
+// Get returns the first value of the extra argument with the given name.
+// It returns an empty string if the argument wasn't sent.
+func (e CatalogExtra) Get(name string) string {
+	return e.Values.Get(name)
+}
+
+// parseCatalogExtra turns the parsed extra arguments of a catalog request into a CatalogExtra.
+func parseCatalogExtra(extra url.Values) (CatalogExtra, error) {
+	catalogExtra := CatalogExtra{
+		Search: extra.Get("search"),
+		Genre:  extra.Get("genre"),
+		Values: extra,
+	}
+	if skip := extra.Get("skip"); skip != "" {
+		var err error
+		catalogExtra.Skip, err = strconv.Atoi(skip)
+		if err != nil || catalogExtra.Skip < 0 {
+			return CatalogExtra{}, fmt.Errorf("%w: skip must be a non-negative integer", errInvalidExtra)
+		}
+	}
+	return catalogExtra, nil
+}
+
+// validateCatalogExtra checks the extra arguments of a catalog request against the ExtraItems of the requested catalog.
+// Catalogs that aren't declared in the given list aren't validated, because the manifest callback can add catalogs at runtime.
+func validateCatalogExtra(catalogs []CatalogItem, catalogType, catalogID string, extra url.Values) error {
+	i := slices.IndexFunc(catalogs, func(catalog CatalogItem) bool {
+		return catalog.Type == catalogType && catalog.ID == catalogID
+	})
+	if i == -1 {
+		return nil
+	}
+	extraItems := catalogs[i].Extra
+
+	// Only declared extras are allowed
+	for name := range extra {
+		if !slices.ContainsFunc(extraItems, func(extraItem ExtraItem) bool { return extraItem.Name == name }) {
+			return fmt.Errorf("%w: %q isn't supported by the catalog", errInvalidExtra, name)
+		}
+	}
+
+	for _, extraItem := range extraItems {
+		values := extra[extraItem.Name]
+		if len(values) == 0 {
+			if extraItem.IsRequired {
+				return fmt.Errorf("%w: %q is required", errInvalidExtra, extraItem.Name)
+			}
+			continue
+		}
+		// Stremio's default limit is 1
+		limit := extraItem.OptionsLimit
+		if limit == 0 {
+			limit = 1
+		}
+		if len(values) > limit {
+			return fmt.Errorf("%w: %q can have at most %v values", errInvalidExtra, extraItem.Name, limit)
+		}
+		if len(extraItem.Options) > 0 {
+			for _, value := range values {
+				if !slices.Contains(extraItem.Options, value) {
+					return fmt.Errorf("%w: %q isn't an option of %q", errInvalidExtra, value, extraItem.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
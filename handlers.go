@@ -2,21 +2,21 @@ package stremio
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"reflect"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/Dasio/go-stremio/pkg/cinemeta"
+	"github.com/Dasio/go-stremio/internal/singleflight"
+	"github.com/VictoriaMetrics/metrics"
 )
 
 type customEndpoint struct {
@@ -25,16 +25,6 @@ type customEndpoint struct {
 	handler http.HandlerFunc
 }
 
-// generateETag generates an ETag for the given data.
-func generateETag(data any) string {
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return ""
-	}
-	hash := sha256.Sum256(jsonData)
-	return hex.EncodeToString(hash[:])
-}
-
 // createManifestHandler creates a handler for manifest requests.
 func createManifestHandler(manifest Manifest, logger *slog.Logger, callback ManifestCallback, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -48,7 +38,7 @@ func createManifestHandler(manifest Manifest, logger *slog.Logger, callback Mani
 		decodedUserData, err := decodeUserData(userData, userDataType, logger, userDataIsBase64)
 		if err != nil {
 			logger.Error("Failed to decode user data", "error", err)
-			http.Error(w, "Invalid user data", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "Invalid user data")
 			return
 		}
 
@@ -56,7 +46,7 @@ func createManifestHandler(manifest Manifest, logger *slog.Logger, callback Mani
 		if callback != nil {
 			status := callback(r.Context(), &manifest, decodedUserData)
 			if status >= 400 {
-				http.Error(w, "Manifest callback returned error", status)
+				writeError(w, status, "Manifest callback returned error")
 				return
 			}
 		}
@@ -67,19 +57,91 @@ func createManifestHandler(manifest Manifest, logger *slog.Logger, callback Mani
 	}
 }
 
-// createCatalogHandler creates a handler for catalog requests.
-func createCatalogHandler(handlers map[string]CatalogHandler, cacheAge int, cachePublic bool, handleEtag bool, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
+// writeError writes a JSON error body like {"error": "Not found"} with the given status code.
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// writeHandlerError writes the error response for a HandlerError, with a Retry-After header if it has a retry hint.
+func writeHandlerError(w http.ResponseWriter, err *HandlerError) {
+	if err.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(err.RetryAfter.Seconds()))))
+	}
+	writeError(w, err.status(), err.message())
+}
+
+// logHandlerError logs a HandlerError with a level depending on its status class:
+// Server errors are logged as errors and client errors (like "404 Not Found") only as debug messages,
+// because the request logging middleware already logs their status.
+func logHandlerError(ctx context.Context, logger *slog.Logger, err *HandlerError, resource string) {
+	level := slog.LevelDebug
+	if err.status() >= 500 {
+		level = slog.LevelError
+	}
+	logger.Log(ctx, level, "Handler returned error", "resource", resource, "status", err.status(), "error", err.Err)
+}
+
+// resourceConfig contains the caching and metrics options for a resource handler.
+type resourceConfig struct {
+	cacheAge    int
+	cachePublic bool
+	handleEtag  bool
+	// If true, handler errors are counted in the "handler_errors_total" metric.
+	metrics bool
+	// If set, responses are cached on the server side for cacheAge seconds.
+	responseCache ResponseCache
+	// Seconds after cacheAge during which a cached response is served while it's refreshed in the background.
+	staleRevalidate int
+	// Seconds after cacheAge during which a cached response is served when the handler returns an error.
+	staleError int
+	// If set, identical concurrent requests share one handler call.
+	coalescer *singleflight.Group[CachedResponse]
+	// If set, handler errors lead to empty responses according to the policy.
+	emptyResponse *EmptyResponsePolicy
+}
+
+// resourceFunc is the type-independent form of the resource handlers like StreamHandler or MetaHandler.
+// The extra parameter contains the request's "extra" arguments like the search query of a catalog request.
+// It's nil if the request didn't contain any.
+type resourceFunc func(ctx context.Context, id string, extra url.Values, userData any) (any, error)
+
+// errInvalidExtra signals that the extra arguments of a request are invalid.
+// It leads to a "400 Bad Request" response with the error message in the JSON body.
+var errInvalidExtra = errors.New("invalid extra arguments")
+
+// createResourceHandler creates a handler for resource requests like "/stream/movie/tt1254207.json".
+// The result of the type's handler is returned as JSON object with the result under the given key, e.g. {"streams": items},
+// together with the cache hints that the handler set with SetCacheHints().
+func createResourceHandler(resource string, key string, handlers map[string]resourceFunc, cfg resourceConfig, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
+	// Deduplicates background refreshes of stale responses
+	var refreshes singleflight.Group[CachedResponse]
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get type and ID from path parameters
 		typeStr := r.PathValue("type")
 		id := r.PathValue("id")
 		if typeStr == "" || id == "" {
-			http.Error(w, "Missing type or id parameter", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "Missing type or id parameter")
 			return
 		}
 		// Strip .json extension from id
 		id = strings.TrimSuffix(id, ".json")
 
+		// Parse extra arguments like "search=foo&skip=100". The router puts them into the path values in their escaped form.
+		var extra url.Values
+		if extraStr := r.PathValue("extra"); extraStr != "" {
+			var err error
+			extra, err = url.ParseQuery(strings.TrimSuffix(extraStr, ".json"))
+			if err != nil {
+				logger.Warn("Couldn't parse extra arguments", "error", err)
+				writeError(w, http.StatusBadRequest, "Invalid extra arguments")
+				return
+			}
+		}
+
 		// Get user data from URL
 		userData := r.PathValue("userData")
 		if userData == "" {
@@ -90,118 +152,206 @@ func createCatalogHandler(handlers map[string]CatalogHandler, cacheAge int, cach
 		decodedUserData, err := decodeUserData(userData, userDataType, logger, userDataIsBase64)
 		if err != nil {
 			logger.Error("Failed to decode user data", "error", err)
-			http.Error(w, "Invalid user data", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "Invalid user data")
 			return
 		}
 
 		// Get handler for type
 		handler, ok := handlers[typeStr]
 		if !ok {
-			http.Error(w, "Unsupported type", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "Unsupported type")
 			return
 		}
 
-		// Call handler
-		items, err := handler(r.Context(), id, decodedUserData)
-		if err != nil {
-			logger.Error("Catalog handler returned error", "error", err)
-			http.Error(w, "Failed to get catalog", http.StatusInternalServerError)
-			return
+		// Let the metrics middleware know what was requested
+		if info := getRequestInfo(r.Context()); info != nil {
+			info.resource = resource
+			info.typ = typeStr
+			info.withUserData = userData != ""
 		}
 
-		// Set cache headers
-		if cacheAge > 0 {
-			w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(cacheAge))
-		}
-		if cachePublic {
-			w.Header().Set("Cache-Control", "public")
+		// Identifies identical requests for the server-side cache and request coalescing
+		var requestKey string
+		if cfg.responseCache != nil || cfg.coalescer != nil {
+			requestKey = responseCacheKey(resource, typeStr, id, extra, userData)
 		}
 
-		// Handle ETag
-		if handleEtag {
-			etag := generateETag(items)
-			w.Header().Set("ETag", etag)
-			if r.Header.Get("If-None-Match") == etag {
-				w.WriteHeader(http.StatusNotModified)
-				return
+		// Call handler and return result as {key: result}
+		callHandler := func(ctx context.Context) (CachedResponse, error) {
+			ctx, hintsHolder := withCacheHintsHolder(ctx)
+			result, err := handler(ctx, id, extra, decodedUserData)
+			if err != nil && cfg.metrics && toHandlerError(err, "").status() >= 500 {
+				counterName := fmt.Sprintf(`handler_errors_total{resource="%v",type="%v"}`, resource, typeStr)
+				metrics.GetOrCreateCounter(counterName).Inc()
+			}
+			if err != nil {
+				return CachedResponse{}, err
+			}
+			hints := hintsHolder.get()
+			body, err := marshalResponse(key, result, hints)
+			if err != nil {
+				return CachedResponse{}, err
+			}
+			response := CachedResponse{Body: body, Created: time.Now(), Hints: hints}
+			if cfg.responseCache != nil {
+				if err := cfg.responseCache.Set(requestKey, response); err != nil {
+					logger.Error("Couldn't cache response", "resource", resource, "error", err)
+				}
 			}
+			return response, nil
 		}
 
-		// Return items
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"metas": items})
-	}
-}
-
-// create object fromt his
-
-// createStreamHandler creates a handler for stream requests.
-func createStreamHandler(handlers map[string]StreamHandler, cacheAge int, cachePublic bool, handleEtag bool, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) { // Get type and ID from path parameters
-		typeStr := r.PathValue("type")
-		id := r.PathValue("id")
-		if typeStr == "" || id == "" {
-			http.Error(w, "Missing type or id parameter", http.StatusBadRequest)
-			return
+		// Serve the response from the server-side cache if it's fresh, or stale but within the stale-while-revalidate window
+		// The cache hints of the cached response take precedence over the durations from the options.
+		var cached CachedResponse
+		var found bool
+		var cachedCfg resourceConfig
+		if cfg.responseCache != nil {
+			cached, found, err = cfg.responseCache.Get(requestKey)
+			if err != nil {
+				logger.Error("Couldn't get response from cache", "resource", resource, "error", err)
+			}
+			cachedCfg = cfg.withHints(cached.Hints)
+			age := time.Since(cached.Created)
+			maxAge := time.Duration(cachedCfg.cacheAge) * time.Second
+			fresh := found && age < maxAge
+			revalidate := found && !fresh && age < maxAge+time.Duration(cachedCfg.staleRevalidate)*time.Second
+			if cfg.metrics {
+				result := "miss"
+				if fresh {
+					result = "hit"
+				} else if revalidate {
+					result = "stale"
+				}
+				counterName := fmt.Sprintf(`response_cache_requests_total{resource="%v",result="%v"}`, resource, result)
+				metrics.GetOrCreateCounter(counterName).Inc()
+			}
+			if revalidate {
+				go func() {
+					// The refresh must outlive the request, and concurrent requests for the same stale response only trigger one refresh
+					_, err, _ := refreshes.Do(requestKey, func() (CachedResponse, error) {
+						return callHandler(context.WithoutCancel(r.Context()))
+					})
+					if err != nil && toHandlerError(err, "").status() >= 500 {
+						logger.Warn("Couldn't refresh stale response", "resource", resource, "error", err)
+					}
+				}()
+			}
+			if fresh || revalidate {
+				writeCachedResponse(w, r, cached, userData, cachedCfg)
+				return
+			}
 		}
-		// Strip .json extension from id
-		id = strings.TrimSuffix(id, ".json")
 
-		// Get user data from URL
-		userData := r.PathValue("userData")
-		if userData == "" {
-			userData = r.URL.Query().Get("userData")
+		var response CachedResponse
+		if cfg.coalescer != nil {
+			var shared bool
+			response, err, shared = cfg.coalescer.Do(requestKey, func() (CachedResponse, error) {
+				// The call is shared, so it must not be canceled when the first client goes away
+				return callHandler(context.WithoutCancel(r.Context()))
+			})
+			if shared && cfg.metrics {
+				metrics.GetOrCreateCounter(fmt.Sprintf(`coalesced_requests_total{resource="%v"}`, resource)).Inc()
+			}
+		} else {
+			response, err = callHandler(r.Context())
 		}
-
-		// Decode user data if needed
-		decodedUserData, err := decodeUserData(userData, userDataType, logger, userDataIsBase64)
 		if err != nil {
-			logger.Error("Failed to decode user data", "error", err)
-			http.Error(w, "Invalid user data", http.StatusBadRequest)
+			handlerErr := toHandlerError(err, "Failed to get "+resource)
+			// Serve the stale response if it's within the stale-if-error window and the error isn't the client's fault
+			if handlerErr.status() >= 500 && found && time.Since(cached.Created) < time.Duration(cachedCfg.cacheAge+cachedCfg.staleError)*time.Second {
+				logger.Warn("Handler returned error, serving stale response", "resource", resource, "error", err)
+				if cfg.metrics {
+					metrics.GetOrCreateCounter(fmt.Sprintf(`response_cache_requests_total{resource="%v",result="stale_error"}`, resource)).Inc()
+				}
+				writeCachedResponse(w, r, cached, userData, cachedCfg)
+				return
+			}
+			logHandlerError(r.Context(), logger, handlerErr, resource)
+			if policy := cfg.emptyResponse; policy != nil && (handlerErr.status() == http.StatusNotFound || (policy.OnError && handlerErr.status() >= 500)) {
+				writeEmptyResponse(w, r, key, userData, cfg)
+				return
+			}
+			writeHandlerError(w, handlerErr)
 			return
 		}
 
-		// Get handler for type
-		handler, ok := handlers[typeStr]
-		if !ok {
-			http.Error(w, "Unsupported type", http.StatusBadRequest)
-			return
-		}
+		writeResponse(w, r, response.Body, response.Created, userData, cfg.withHints(response.Hints))
+	}
+}
 
-		// Call handler
-		items, err := handler(r.Context(), id, decodedUserData)
-		if err != nil {
-			if errors.Is(err, ErrNotFound) {
-				http.Error(w, "Not found", http.StatusNotFound)
-				return
+// writeCachedResponse writes a response from the server-side cache with an Age header,
+// so that clients and CDNs subtract the time it was already cached from its max-age and recognize stale responses as stale.
+func writeCachedResponse(w http.ResponseWriter, r *http.Request, cached CachedResponse, userData string, cfg resourceConfig) {
+	age := max(time.Since(cached.Created), 0)
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	writeResponse(w, r, cached.Body, cached.Created, userData, cfg)
+}
+
+// writeEmptyResponse writes an empty response like {"streams": []} according to the config's empty response policy.
+// The Cache-Control header contains the cache durations of the policy instead of the ones of the resource.
+func writeEmptyResponse(w http.ResponseWriter, r *http.Request, key, userData string, cfg resourceConfig) {
+	body, err := emptyResponseBody(key, cfg.emptyResponse)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create empty response")
+		return
+	}
+	cfg.cacheAge = int(cfg.emptyResponse.CacheMaxAge.Seconds())
+	cfg.staleRevalidate = int(cfg.emptyResponse.StaleRevalidate.Seconds())
+	cfg.staleError = int(cfg.emptyResponse.StaleError.Seconds())
+	writeResponse(w, r, body, time.Now(), userData, cfg)
+}
+
+// createCatalogHandler creates a handler for catalog requests.
+// The extra arguments of the requests are validated against the ExtraItems of the given catalogs.
+func createCatalogHandler(handlers map[string]CatalogHandler, catalogs []CatalogItem, cfg resourceConfig, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
+	typeHandlers := make(map[string]resourceFunc, len(handlers))
+	for t, handler := range handlers {
+		typeHandlers[t] = func(ctx context.Context, id string, extra url.Values, userData any) (any, error) {
+			if err := validateCatalogExtra(catalogs, t, id, extra); err != nil {
+				return nil, err
 			}
-			logger.Error("Stream handler returned error", "error", err)
-			http.Error(w, "Failed to get streams", http.StatusInternalServerError)
-			return
+			catalogExtra, err := parseCatalogExtra(extra)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, id, catalogExtra, userData)
 		}
+	}
+	return createResourceHandler("catalog", "metas", typeHandlers, cfg, logger, userDataType, userDataIsBase64)
+}
 
-		// Set cache headers
-		if cacheAge > 0 {
-			w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(cacheAge))
-		}
-		if cachePublic {
-			w.Header().Set("Cache-Control", "public")
+// createStreamHandler creates a handler for stream requests.
+func createStreamHandler(handlers map[string]StreamHandler, cfg resourceConfig, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
+	typeHandlers := make(map[string]resourceFunc, len(handlers))
+	for t, handler := range handlers {
+		typeHandlers[t] = func(ctx context.Context, id string, _ url.Values, userData any) (any, error) {
+			return handler(ctx, id, userData)
 		}
+	}
+	return createResourceHandler("stream", "streams", typeHandlers, cfg, logger, userDataType, userDataIsBase64)
+}
 
-		// Handle ETag
-		if handleEtag {
-			etag := generateETag(items)
-			w.Header().Set("ETag", etag)
-			if r.Header.Get("If-None-Match") == etag {
-				w.WriteHeader(http.StatusNotModified)
-				return
-			}
+// createMetaHandler creates a handler for meta requests.
+func createMetaHandler(handlers map[string]MetaHandler, cfg resourceConfig, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
+	typeHandlers := make(map[string]resourceFunc, len(handlers))
+	for t, handler := range handlers {
+		typeHandlers[t] = func(ctx context.Context, id string, _ url.Values, userData any) (any, error) {
+			return handler(ctx, id, userData)
 		}
+	}
+	return createResourceHandler("meta", "meta", typeHandlers, cfg, logger, userDataType, userDataIsBase64)
+}
 
-		// Return items as {"streams": items}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(map[string]any{"streams": items})
+// createAddonCatalogHandler creates a handler for addon catalog requests.
+func createAddonCatalogHandler(handlers map[string]AddonCatalogHandler, cfg resourceConfig, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
+	typeHandlers := make(map[string]resourceFunc, len(handlers))
+	for t, handler := range handlers {
+		typeHandlers[t] = func(ctx context.Context, id string, _ url.Values, userData any) (any, error) {
+			return handler(ctx, id, userData)
+		}
 	}
+	return createResourceHandler("addon_catalog", "addons", typeHandlers, cfg, logger, userDataType, userDataIsBase64)
 }
 
 func createRootHandler(redirectURL string, logger *slog.Logger) http.HandlerFunc {
@@ -248,109 +398,3 @@ func decodeUserData(data string, t reflect.Type, logger *slog.Logger, userDataIs
 	logger.Info("Decoded user data", "userData", fmt.Sprintf("%+v", userData))
 	return userData, nil
 }
-
-// createMetaMiddleware creates a middleware that fetches meta information for stream requests.
-func createMetaMiddleware(metaClient MetaFetcher, putMetaInContext bool, logMediaName bool, logger *slog.Logger) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get type and ID from path parameters
-			typeStr := r.PathValue("type")
-			id := r.PathValue("id")
-			if typeStr == "" || id == "" {
-				http.Error(w, "Missing type or id parameter", http.StatusBadRequest)
-				return
-			}
-			// Strip .json extension from id
-			id = strings.TrimSuffix(id, ".json")
-
-			// Get meta information
-			var meta cinemeta.Meta
-			var err error
-			if typeStr == "movie" {
-				meta, err = metaClient.GetMovie(r.Context(), id)
-			} else if typeStr == "series" {
-				// Get season and episode from URL
-				season := r.URL.Query().Get("season")
-				episode := r.URL.Query().Get("episode")
-				if season == "" || episode == "" {
-					http.Error(w, "Missing season or episode parameter", http.StatusBadRequest)
-					return
-				}
-				seasonNum, err := strconv.Atoi(season)
-				if err != nil {
-					http.Error(w, "Invalid season parameter", http.StatusBadRequest)
-					return
-				}
-				episodeNum, err := strconv.Atoi(episode)
-				if err != nil {
-					http.Error(w, "Invalid episode parameter", http.StatusBadRequest)
-					return
-				}
-				meta, err = metaClient.GetTVShow(r.Context(), id, seasonNum, episodeNum)
-			} else {
-				http.Error(w, "Unsupported type", http.StatusBadRequest)
-				return
-			}
-
-			if err != nil {
-				logger.Error("Failed to get meta information", "error", err)
-				http.Error(w, "Failed to get meta information", http.StatusInternalServerError)
-				return
-			}
-
-			// Log media name if enabled
-			if logMediaName {
-				logger.Info("Media name", "name", meta.Name)
-			}
-
-			// Put meta in context if enabled
-			if putMetaInContext {
-				ctx := context.WithValue(r.Context(), "meta", meta)
-				r = r.WithContext(ctx)
-			}
-
-			// Call next handler
-			next.ServeHTTP(w, r)
-		})
-	}
-}
-
-// addRouteMatcherMiddleware adds a middleware that matches routes and puts request info in the context.
-func addRouteMatcherMiddleware(mux *http.ServeMux, configurationRequired bool, streamIDregex *regexp.Regexp, logger *slog.Logger) {
-	// Create a middleware handler
-	middleware := func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Check if configuration is required
-			if configurationRequired {
-				userData := r.PathValue("userData")
-				if userData == "" {
-					userData = r.URL.Query().Get("userData")
-				}
-				if userData == "" {
-					http.Error(w, "Configuration required", http.StatusBadRequest)
-					return
-				}
-			}
-
-			// Check if stream ID matches regex
-			if streamIDregex != nil {
-				id := r.PathValue("id")
-				if id == "" {
-					id = r.URL.Query().Get("id")
-				}
-				if id != "" && !streamIDregex.MatchString(id) {
-					http.Error(w, "Invalid stream ID", http.StatusBadRequest)
-					return
-				}
-			}
-
-			// Call the next handler
-			next.ServeHTTP(w, r)
-		})
-	}
-
-	// Wrap the mux with the middleware
-	originalMux := mux
-	mux = http.NewServeMux()
-	mux.Handle("/", middleware(originalMux))
-}
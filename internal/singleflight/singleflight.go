@@ -0,0 +1,60 @@
+// Package singleflight provides a mechanism to suppress duplicate function calls that run at the same time.
+package singleflight
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrPanicked is the error that waiting callers get when the function panicked in the original caller,
+// which gets the panic itself.
+var ErrPanicked = errors.New("singleflight: function panicked")
+
+// call is an in-flight or completed Do call.
+type call[T any] struct {
+	wg  sync.WaitGroup
+	val T
+	err error
+}
+
+// Group deduplicates calls with the same key. The zero value is ready to use.
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+// Do executes and returns the results of fn, making sure that only one execution is in-flight for a given key at a time.
+// If a duplicate call comes in, the duplicate caller waits for the original one to complete and receives the same results.
+// The shared return value signals if the caller received the results of another caller's execution of fn.
+func (g *Group[T]) Do(key string, fn func() (T, error)) (val T, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*call[T]{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err, true
+	}
+	c := &call[T]{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// Remove the call even if fn panics, so that waiting callers and later calls aren't blocked forever.
+	// Waiting callers must not mistake the zero value for a result then, so they get an error.
+	returned := false
+	defer func() {
+		if !returned {
+			var zero T
+			c.val, c.err = zero, ErrPanicked
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	returned = true
+	return c.val, c.err, false
+}
@@ -0,0 +1,80 @@
+package singleflight
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDo(t *testing.T) {
+	var g Group[int]
+	var calls int
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]int, 5)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, err, _ := g.Do("key", func() (int, error) {
+				<-start
+				calls++
+				return 42, nil
+			})
+			require.NoError(t, err)
+			results[i] = val
+		}()
+	}
+	// Give the goroutines time to join the call
+	time.Sleep(50 * time.Millisecond)
+	close(start)
+	wg.Wait()
+	require.Equal(t, 1, calls)
+	require.Equal(t, []int{42, 42, 42, 42, 42}, results)
+}
+
+func TestDoPanic(t *testing.T) {
+	var g Group[int]
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	// The original caller gets the panic
+	panicked := make(chan any)
+	go func() {
+		defer func() {
+			panicked <- recover()
+		}()
+		g.Do("key", func() (int, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+
+	// Waiting callers get an error instead of the zero value
+	<-started
+	waiterErr := make(chan error)
+	go func() {
+		val, err, shared := g.Do("key", func() (int, error) {
+			return 1, nil
+		})
+		require.True(t, shared)
+		require.Zero(t, val)
+		waiterErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	require.Equal(t, "boom", <-panicked)
+	require.ErrorIs(t, <-waiterErr, ErrPanicked)
+
+	// Later calls aren't affected
+	val, err, shared := g.Do("key", func() (int, error) {
+		return 1, nil
+	})
+	require.NoError(t, err)
+	require.False(t, shared)
+	require.Equal(t, 1, val)
+}
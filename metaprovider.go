@@ -0,0 +1,394 @@
+package stremio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dasio/go-stremio/pkg/cinemeta"
+)
+
+var (
+	// ErrUnsupportedID signals that a MetaProvider doesn't handle the kind of ID (like "kitsu:1") or the type that was requested.
+	// The addon passes stream requests with such IDs to the stream handler without meta, and a MetaChain tries the next provider.
+	ErrUnsupportedID = errors.New("unsupported ID")
+
+	// errInvalidMediaID signals that an ID has the right prefix, but can't be parsed, like a TV show episode ID without episode.
+	errInvalidMediaID = errors.New("invalid media ID")
+)
+
+// MediaMeta is the meta of a movie, TV show or other media that a MetaProvider returns.
+// It's the MetaItem that Stremio knows from meta responses, plus the requested episode.
+type MediaMeta struct {
+	MetaItem
+	// The episode that was requested with an episode ID like "tt0944947:1:2" or "kitsu:11:3",
+	// or nil if the ID wasn't for an episode or the provider doesn't know the episode (yet).
+	Episode *VideoItem `json:"episode,omitempty"`
+
+	// The original Cinemeta meta, if the meta was fetched with a MetaFetcher.
+	// The addon puts it into the context as well, for handlers that use cinemeta.FromContext().
+	cinemeta *cinemeta.Meta
+}
+
+// displayName returns the name for logs, like "Big Buck Bunny (2008)" or "Game of Thrones S01E02 (2011-2019)".
+func (m MediaMeta) displayName() string {
+	name := m.Name
+	if m.Episode != nil {
+		season, seasonErr := strconv.Atoi(m.Episode.Season)
+		episode, episodeErr := strconv.Atoi(m.Episode.Episode)
+		if seasonErr == nil && episodeErr == nil {
+			name += fmt.Sprintf(" S%02dE%02d", season, episode)
+		} else if episodeErr == nil {
+			name += fmt.Sprintf(" E%02d", episode)
+		}
+	}
+	if m.ReleaseInfo == "" {
+		return name
+	}
+	return fmt.Sprintf("%v (%v)", name, m.ReleaseInfo)
+}
+
+// MetaProvider returns the meta for the type and ID of a request, like "movie" and "tt1254207",
+// or "series" and an episode ID like "tt0944947:1:2" or "kitsu:11:3".
+// It should return ErrUnsupportedID if it doesn't handle the kind of ID or the type, and ErrNotFound if it doesn't know the ID.
+// Implementations must be safe for concurrent use.
+type MetaProvider interface {
+	GetMeta(ctx context.Context, t, id string) (MediaMeta, error)
+}
+
+// metaContextKey is the context key for the MediaMeta.
+type metaContextKey struct{}
+
+// MetaFromContext returns the meta of the requested movie or TV show episode, which the addon puts into the context of stream handlers
+// if PutMetaInContext is set in the options.
+// The boolean return value signals if there was a meta in the context.
+func MetaFromContext(ctx context.Context) (MediaMeta, bool) {
+	meta, ok := ctx.Value(metaContextKey{}).(MediaMeta)
+	return meta, ok
+}
+
+// newMetaContext returns a copy of the parent context that contains the meta,
+// and the original Cinemeta meta for handlers that use cinemeta.FromContext().
+func newMetaContext(ctx context.Context, meta MediaMeta) context.Context {
+	if meta.cinemeta != nil {
+		ctx = cinemeta.NewContext(ctx, *meta.cinemeta)
+	}
+	return context.WithValue(ctx, metaContextKey{}, meta)
+}
+
+var _ MetaProvider = (*MetaRegistry)(nil)
+
+// MetaRegistry is a MetaProvider that passes requests to the provider that's registered for the prefix of the requested ID,
+// like "tt" for IMDb IDs, "kitsu:" for Kitsu IDs and "tmdb:" for TMDB IDs.
+// If multiple prefixes match, the longest one wins.
+// IDs without a registered prefix lead to ErrUnsupportedID.
+type MetaRegistry struct {
+	providers map[string]MetaProvider
+	lock      *sync.RWMutex
+}
+
+// NewMetaRegistry creates a new MetaRegistry without any providers.
+func NewMetaRegistry() *MetaRegistry {
+	return &MetaRegistry{
+		providers: map[string]MetaProvider{},
+		lock:      &sync.RWMutex{},
+	}
+}
+
+// Register registers the provider for IDs with the given prefix, replacing a previously registered one.
+func (r *MetaRegistry) Register(idPrefix string, provider MetaProvider) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.providers[idPrefix] = provider
+}
+
+// GetMeta returns the meta from the provider that's registered for the ID's prefix.
+func (r *MetaRegistry) GetMeta(ctx context.Context, t, id string) (MediaMeta, error) {
+	r.lock.RLock()
+	var provider MetaProvider
+	var longestPrefix string
+	for prefix, p := range r.providers {
+		if strings.HasPrefix(id, prefix) && (provider == nil || len(prefix) > len(longestPrefix)) {
+			provider = p
+			longestPrefix = prefix
+		}
+	}
+	r.lock.RUnlock()
+
+	if provider == nil {
+		return MediaMeta{}, fmt.Errorf("%w: no meta provider registered for %q", ErrUnsupportedID, id)
+	}
+	return provider.GetMeta(ctx, t, id)
+}
+
+var _ MetaProvider = (*MetaChain)(nil)
+
+// MetaChain is a MetaProvider that asks multiple providers in order and returns the meta of the first one that succeeds.
+// This way you can for example fall back to a Stremio addon's meta endpoint when the primary provider is down or doesn't know an ID.
+type MetaChain struct {
+	providers []MetaProvider
+}
+
+// NewMetaChain creates a new MetaChain with the given providers, which are asked in the given order.
+func NewMetaChain(providers ...MetaProvider) *MetaChain {
+	return &MetaChain{
+		providers: providers,
+	}
+}
+
+// GetMeta returns the meta of the first provider that succeeds.
+// If all providers fail, the returned error contains all of their errors, so you can check it with errors.Is(),
+// except that it's only ErrUnsupportedID if none of the providers supports the ID.
+func (c *MetaChain) GetMeta(ctx context.Context, t, id string) (MediaMeta, error) {
+	var errs []error
+	for _, provider := range c.providers {
+		meta, err := provider.GetMeta(ctx, t, id)
+		if err == nil {
+			return meta, nil
+		} else if ctxErr := ctx.Err(); ctxErr != nil {
+			return MediaMeta{}, ctxErr
+		} else if !errors.Is(err, ErrUnsupportedID) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return MediaMeta{}, fmt.Errorf("%w: no meta provider in the chain supports %q", ErrUnsupportedID, id)
+	}
+	return MediaMeta{}, errors.Join(errs...)
+}
+
+var _ MetaProvider = cinemetaProvider{}
+
+// cinemetaProvider is a MetaProvider that gets meta from a MetaFetcher like the cinemeta.Client.
+type cinemetaProvider struct {
+	fetcher MetaFetcher
+}
+
+// NewCinemetaProvider creates a MetaProvider that gets meta for IMDb IDs of movies, TV shows and TV show episodes from the given MetaFetcher,
+// for example a cinemeta.Client. Register it for the "tt" prefix in a MetaRegistry or use it in a MetaChain.
+// Other IDs and types lead to ErrUnsupportedID.
+// Besides the MediaMeta, the addon puts the original Cinemeta meta into the context, so cinemeta.FromContext() keeps working.
+func NewCinemetaProvider(fetcher MetaFetcher) MetaProvider {
+	return cinemetaProvider{
+		fetcher: fetcher,
+	}
+}
+
+// GetMeta fetches the meta for a movie ID like "tt1254207", TV show ID like "tt0944947" or TV show episode ID like "tt0944947:1:2".
+// The Episode is only set for episode IDs.
+func (p cinemetaProvider) GetMeta(ctx context.Context, t, id string) (MediaMeta, error) {
+	if (t != "movie" && t != "series") || !strings.HasPrefix(id, "tt") {
+		return MediaMeta{}, fmt.Errorf("%w: Cinemeta only supports IMDb IDs of movies and TV shows", ErrUnsupportedID)
+	}
+
+	var meta cinemeta.Meta
+	var err error
+	if t == "movie" {
+		meta, err = p.fetcher.GetMovie(ctx, id)
+	} else if !strings.Contains(id, ":") {
+		// IDs without season and episode refer to the whole TV show, like the ones in catalogs
+		meta, err = p.getSeries(ctx, id)
+	} else {
+		splitID := strings.Split(id, ":")
+		if len(splitID) != 3 {
+			return MediaMeta{}, fmt.Errorf("%w: TV show ID %q doesn't have the format \"imdbID:season:episode\"", errInvalidMediaID, id)
+		}
+		season, convErr := strconv.Atoi(splitID[1])
+		if convErr != nil {
+			return MediaMeta{}, fmt.Errorf("%w: can't parse season %q as int", errInvalidMediaID, splitID[1])
+		}
+		episode, convErr := strconv.Atoi(splitID[2])
+		if convErr != nil {
+			return MediaMeta{}, fmt.Errorf("%w: can't parse episode %q as int", errInvalidMediaID, splitID[2])
+		}
+		meta, err = p.fetcher.GetTVShow(ctx, splitID[0], season, episode)
+	}
+	if errors.Is(err, cinemeta.ErrNotFound) {
+		return MediaMeta{}, fmt.Errorf("%w: %w", ErrNotFound, err)
+	} else if err != nil {
+		return MediaMeta{}, err
+	}
+	return mediaMetaFromCinemeta(meta), nil
+}
+
+// seriesFetcher is implemented by MetaFetchers that can fetch a TV show without an episode, like the Cinemeta client.
+type seriesFetcher interface {
+	GetSeries(ctx context.Context, imdbID string) (cinemeta.Meta, error)
+}
+
+// getSeries fetches the TV show without an episode.
+// MetaFetchers that can only fetch episodes are asked for the first one, which is then removed from the meta.
+func (p cinemetaProvider) getSeries(ctx context.Context, imdbID string) (cinemeta.Meta, error) {
+	if fetcher, ok := p.fetcher.(seriesFetcher); ok {
+		return fetcher.GetSeries(ctx, imdbID)
+	}
+	meta, err := p.fetcher.GetTVShow(ctx, imdbID, 1, 1)
+	meta.Episode = nil
+	return meta, err
+}
+
+// mediaMetaFromCinemeta converts a Cinemeta meta to a MediaMeta.
+func mediaMetaFromCinemeta(meta cinemeta.Meta) MediaMeta {
+	result := MediaMeta{
+		MetaItem: MetaItem{
+			ID:          meta.ID,
+			Type:        meta.Type,
+			Name:        meta.Name,
+			Genres:      meta.Genres,
+			Director:    meta.Director,
+			Cast:        meta.Cast,
+			Poster:      meta.Poster,
+			PosterShape: meta.PosterShape,
+			Background:  meta.Background,
+			Logo:        meta.Logo,
+			Description: meta.Description,
+			ReleaseInfo: meta.ReleaseInfo,
+			IMDbRating:  meta.IMDbRating,
+			Released:    meta.Released,
+			Runtime:     meta.Runtime,
+			Language:    meta.Language,
+			Country:     meta.Country,
+			Awards:      meta.Awards,
+			Website:     meta.Website,
+		},
+		cinemeta: &meta,
+	}
+	for _, video := range meta.Videos {
+		result.Videos = append(result.Videos, videoItemFromCinemeta(video))
+	}
+	if meta.Episode != nil {
+		episode := videoItemFromCinemeta(*meta.Episode)
+		result.Episode = &episode
+	}
+	return result
+}
+
+// videoItemFromCinemeta converts a Cinemeta video to a VideoItem.
+func videoItemFromCinemeta(video cinemeta.Video) VideoItem {
+	title := video.Name
+	if title == "" {
+		title = video.Title
+	}
+	return VideoItem{
+		ID:        video.ID,
+		Title:     title,
+		Released:  video.Released,
+		Thumbnail: video.Thumbnail,
+		Season:    strconv.Itoa(video.Season),
+		Episode:   strconv.Itoa(video.Episode),
+		Overview:  video.Overview,
+	}
+}
+
+var _ MetaProvider = (*AddonMetaProvider)(nil)
+
+// AddonMetaProvider is a MetaProvider that gets meta from the meta endpoint of any Stremio addon,
+// like Cinemeta for IMDb IDs or community addons for Kitsu or TMDB IDs.
+// For episode IDs like "kitsu:11:3" it requests the meta of the TV show ("kitsu:11")
+// and looks up the episode in its videos, whose IDs are the episode IDs by Stremio's convention.
+type AddonMetaProvider struct {
+	baseURL    string
+	idPrefix   string
+	httpClient *http.Client
+}
+
+// NewAddonMetaProvider creates a new AddonMetaProvider for the addon at the given base URL (without "/manifest.json"),
+// like "https://v3-cinemeta.strem.io", which handles IDs with the given prefix, like "tt" or "kitsu:".
+// Other IDs lead to ErrUnsupportedID.
+// If httpClient is nil, a client with a timeout of 2 seconds is used.
+func NewAddonMetaProvider(baseURL, idPrefix string, httpClient *http.Client) *AddonMetaProvider {
+	if httpClient == nil {
+		httpClient = &http.Client{
+			Timeout: 2 * time.Second,
+		}
+	}
+	return &AddonMetaProvider{
+		baseURL:    strings.TrimSuffix(baseURL, "/"),
+		idPrefix:   idPrefix,
+		httpClient: httpClient,
+	}
+}
+
+// addonVideo is a video in an addon's meta response.
+// Addons send the season and episode as numbers, while VideoItem has strings.
+type addonVideo struct {
+	VideoItem
+	Name    string      `json:"name"`
+	Season  json.Number `json:"season"`
+	Episode json.Number `json:"episode"`
+}
+
+// addonMetaResponse is the body of an addon's meta response.
+type addonMetaResponse struct {
+	Meta *struct {
+		MetaItem
+		Videos []addonVideo `json:"videos"`
+	} `json:"meta"`
+}
+
+// GetMeta requests the meta from the addon's meta endpoint.
+func (p *AddonMetaProvider) GetMeta(ctx context.Context, t, id string) (MediaMeta, error) {
+	if !strings.HasPrefix(id, p.idPrefix) {
+		return MediaMeta{}, fmt.Errorf("%w: addon at %v only supports IDs with prefix %q", ErrUnsupportedID, p.baseURL, p.idPrefix)
+	}
+	// The meta ID is the prefix and the first part after it, like "kitsu:11" for "kitsu:11:3" or "tt0944947" for "tt0944947:1:2"
+	metaID := p.idPrefix + strings.SplitN(strings.TrimPrefix(id, p.idPrefix), ":", 2)[0]
+	if metaID == p.idPrefix {
+		return MediaMeta{}, fmt.Errorf("%w: no ID after the prefix in %q", errInvalidMediaID, id)
+	}
+
+	reqURL := p.baseURL + "/meta/" + url.PathEscape(t) + "/" + url.PathEscape(metaID) + ".json"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return MediaMeta{}, fmt.Errorf("couldn't create request: %w", err)
+	}
+	res, err := p.httpClient.Do(req)
+	if err != nil {
+		return MediaMeta{}, fmt.Errorf("couldn't send request to addon: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return MediaMeta{}, fmt.Errorf("%w: addon at %v doesn't know %v %v", ErrNotFound, p.baseURL, t, metaID)
+	} else if res.StatusCode != http.StatusOK {
+		return MediaMeta{}, fmt.Errorf("bad HTTP response status from addon: %v", res.Status)
+	}
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return MediaMeta{}, fmt.Errorf("couldn't read response body: %w", err)
+	}
+	var addonRes addonMetaResponse
+	if err := json.Unmarshal(body, &addonRes); err != nil {
+		return MediaMeta{}, fmt.Errorf("couldn't unmarshal response body: %w", err)
+	}
+	// Stremio addons usually respond with an empty meta instead of a 404 for unknown IDs
+	if addonRes.Meta == nil || addonRes.Meta.ID == "" {
+		return MediaMeta{}, fmt.Errorf("%w: addon at %v doesn't know %v %v", ErrNotFound, p.baseURL, t, metaID)
+	}
+
+	meta := MediaMeta{
+		MetaItem: addonRes.Meta.MetaItem,
+	}
+	meta.Videos = nil
+	for _, video := range addonRes.Meta.Videos {
+		videoItem := video.VideoItem
+		if videoItem.Title == "" {
+			videoItem.Title = video.Name
+		}
+		videoItem.Season = video.Season.String()
+		videoItem.Episode = video.Episode.String()
+		meta.Videos = append(meta.Videos, videoItem)
+		if videoItem.ID == id && id != metaID {
+			episode := videoItem
+			meta.Episode = &episode
+		}
+	}
+	return meta, nil
+}
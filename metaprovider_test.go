@@ -0,0 +1,261 @@
+package stremio
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Dasio/go-stremio/pkg/cinemeta"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestMetaAddon starts a server that stands in for a Stremio addon with a meta endpoint.
+// It responds to requests for paths in metas with the given body, to "/meta/movie/kitsu:404.json" with a 404 status
+// and to all other requests with an empty meta, like most addons do for unknown IDs.
+func newTestMetaAddon(t *testing.T, metas map[string]string) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+	var requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path == "/meta/movie/kitsu:404.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if body, ok := metas[r.URL.Path]; ok {
+			w.Write([]byte(body))
+			return
+		}
+		w.Write([]byte(`{"meta":{}}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+var testKitsuMetas = map[string]string{
+	"/meta/series/kitsu:11.json": `{"meta":{"id":"kitsu:11","type":"series","name":"Naruto","releaseInfo":"2002-2007","videos":[` +
+		`{"id":"kitsu:11:1","title":"Enter: Naruto Uzumaki!","season":1,"episode":1},` +
+		`{"id":"kitsu:11:2","name":"My Name is Konohamaru!","season":1,"episode":2}]}}`,
+	"/meta/movie/kitsu:42.json": `{"meta":{"id":"kitsu:42","type":"movie","name":"Akira","releaseInfo":"1988"}}`,
+}
+
+func TestAddonMetaProvider(t *testing.T) {
+	server, _ := newTestMetaAddon(t, testKitsuMetas)
+	provider := NewAddonMetaProvider(server.URL+"/", "kitsu:", nil)
+
+	t.Run("movie", func(t *testing.T) {
+		meta, err := provider.GetMeta(context.Background(), "movie", "kitsu:42")
+		require.NoError(t, err)
+		require.Equal(t, "Akira", meta.Name)
+		require.Nil(t, meta.Episode)
+		require.Equal(t, "Akira (1988)", meta.displayName())
+	})
+
+	t.Run("episode", func(t *testing.T) {
+		meta, err := provider.GetMeta(context.Background(), "series", "kitsu:11:2")
+		require.NoError(t, err)
+		require.Equal(t, "kitsu:11", meta.ID)
+		require.Len(t, meta.Videos, 2)
+		require.NotNil(t, meta.Episode)
+		require.Equal(t, "My Name is Konohamaru!", meta.Episode.Title)
+		require.Equal(t, "1", meta.Episode.Season)
+		require.Equal(t, "2", meta.Episode.Episode)
+		require.Equal(t, "Naruto S01E02 (2002-2007)", meta.displayName())
+	})
+
+	t.Run("unknown episode", func(t *testing.T) {
+		meta, err := provider.GetMeta(context.Background(), "series", "kitsu:11:99")
+		require.NoError(t, err)
+		require.Equal(t, "Naruto", meta.Name)
+		require.Nil(t, meta.Episode)
+	})
+
+	t.Run("empty meta", func(t *testing.T) {
+		_, err := provider.GetMeta(context.Background(), "movie", "kitsu:1")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("404", func(t *testing.T) {
+		_, err := provider.GetMeta(context.Background(), "movie", "kitsu:404")
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+
+	t.Run("unsupported ID", func(t *testing.T) {
+		_, err := provider.GetMeta(context.Background(), "movie", "tt1254207")
+		require.ErrorIs(t, err, ErrUnsupportedID)
+	})
+}
+
+func TestCinemetaProvider(t *testing.T) {
+	provider := NewCinemetaProvider(stubMetaFetcher{})
+
+	meta, err := provider.GetMeta(context.Background(), "series", "tt0944947:1:2")
+	require.NoError(t, err)
+	require.Equal(t, "Show tt0944947", meta.Name)
+	require.NotNil(t, meta.Episode)
+	require.Equal(t, "Show tt0944947 S01E02 (2011-2019)", meta.displayName())
+
+	// TV show IDs without season and episode, like in catalogs
+	meta, err = provider.GetMeta(context.Background(), "series", "tt0944947")
+	require.NoError(t, err)
+	require.Equal(t, "Show tt0944947", meta.Name)
+	require.Nil(t, meta.Episode)
+	require.Equal(t, "Show tt0944947 (2011-2019)", meta.displayName())
+
+	_, err = provider.GetMeta(context.Background(), "series", "tt0944947:1")
+	require.ErrorIs(t, err, errInvalidMediaID)
+	_, err = provider.GetMeta(context.Background(), "movie", "kitsu:42")
+	require.ErrorIs(t, err, ErrUnsupportedID)
+	_, err = provider.GetMeta(context.Background(), "channel", "tt1254207")
+	require.ErrorIs(t, err, ErrUnsupportedID)
+
+	// Cinemeta's not found error is also a stremio.ErrNotFound
+	_, err = NewCinemetaProvider(notFoundMetaFetcher{}).GetMeta(context.Background(), "movie", "tt1254207")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.ErrorIs(t, err, cinemeta.ErrNotFound)
+}
+
+// notFoundMetaFetcher is a MetaFetcher that doesn't know any movie or TV show.
+type notFoundMetaFetcher struct{}
+
+func (notFoundMetaFetcher) GetMovie(ctx context.Context, imdbID string) (cinemeta.Meta, error) {
+	return cinemeta.Meta{}, cinemeta.ErrNotFound
+}
+
+func (notFoundMetaFetcher) GetTVShow(ctx context.Context, imdbID string, season int, episode int) (cinemeta.Meta, error) {
+	return cinemeta.Meta{}, cinemeta.ErrNotFound
+}
+
+func TestMetaRegistry(t *testing.T) {
+	server, _ := newTestMetaAddon(t, testKitsuMetas)
+	registry := NewMetaRegistry()
+	registry.Register("tt", NewCinemetaProvider(stubMetaFetcher{}))
+	registry.Register("kitsu:", NewAddonMetaProvider(server.URL, "kitsu:", nil))
+	// The longest matching prefix wins
+	registry.Register("tt0944947", NewCinemetaProvider(notFoundMetaFetcher{}))
+
+	meta, err := registry.GetMeta(context.Background(), "movie", "tt1254207")
+	require.NoError(t, err)
+	require.Equal(t, "Movie tt1254207", meta.Name)
+
+	meta, err = registry.GetMeta(context.Background(), "movie", "kitsu:42")
+	require.NoError(t, err)
+	require.Equal(t, "Akira", meta.Name)
+
+	_, err = registry.GetMeta(context.Background(), "series", "tt0944947:1:2")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	_, err = registry.GetMeta(context.Background(), "movie", "tmdb:123")
+	require.ErrorIs(t, err, ErrUnsupportedID)
+}
+
+func TestMetaChain(t *testing.T) {
+	server, requests := newTestMetaAddon(t, testKitsuMetas)
+	addonProvider := NewAddonMetaProvider(server.URL, "kitsu:", nil)
+
+	t.Run("fallback", func(t *testing.T) {
+		chain := NewMetaChain(NewCinemetaProvider(failingMetaFetcher{}), NewAddonMetaProvider(server.URL, "tt", nil))
+		// The test addon doesn't know the ID, so both providers fail
+		_, err := chain.GetMeta(context.Background(), "movie", "tt1254207")
+		require.ErrorIs(t, err, cinemeta.ErrCircuitOpen)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		chain = NewMetaChain(NewCinemetaProvider(failingMetaFetcher{}), NewCinemetaProvider(stubMetaFetcher{}))
+		meta, err := chain.GetMeta(context.Background(), "movie", "tt1254207")
+		require.NoError(t, err)
+		require.Equal(t, "Movie tt1254207", meta.Name)
+	})
+
+	t.Run("unsupported providers are skipped", func(t *testing.T) {
+		before := requests.Load()
+		chain := NewMetaChain(NewCinemetaProvider(stubMetaFetcher{}), addonProvider)
+		meta, err := chain.GetMeta(context.Background(), "movie", "kitsu:42")
+		require.NoError(t, err)
+		require.Equal(t, "Akira", meta.Name)
+		require.Equal(t, before+1, requests.Load())
+
+		_, err = chain.GetMeta(context.Background(), "movie", "tmdb:123")
+		require.ErrorIs(t, err, ErrUnsupportedID)
+	})
+
+	t.Run("canceled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		before := requests.Load()
+		chain := NewMetaChain(addonProvider, addonProvider)
+		_, err := chain.GetMeta(ctx, "movie", "kitsu:42")
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, before, requests.Load())
+	})
+}
+
+func TestAddonWithMetaProvider(t *testing.T) {
+	server, _ := newTestMetaAddon(t, testKitsuMetas)
+	registry := NewMetaRegistry()
+	registry.Register("tt", NewCinemetaProvider(stubMetaFetcher{}))
+	registry.Register("kitsu:", NewAddonMetaProvider(server.URL, "kitsu:", nil))
+
+	manifest := Manifest{
+		ID:          "org.myexampleaddon",
+		Version:     "1.0.0",
+		Name:        "simple example",
+		Description: "simple example",
+		Types:       []string{"movie", "series"},
+	}
+	streamHandler := func(ctx context.Context, id string, userData any) ([]StreamItem, error) {
+		meta, ok := MetaFromContext(ctx)
+		if !ok {
+			return []StreamItem{{Title: "no meta"}}, nil
+		}
+		// The Cinemeta meta is only in the context if it came from Cinemeta
+		_, isCinemeta := cinemeta.FromContext(ctx)
+		return []StreamItem{{Title: meta.displayName(), Name: strconv.FormatBool(isCinemeta)}}, nil
+	}
+	streamHandlers := map[string]StreamHandler{
+		"movie":  streamHandler,
+		"series": streamHandler,
+	}
+	opts := Options{
+		MetaProvider:     registry,
+		PutMetaInContext: true,
+	}
+	addon, err := NewAddon(manifest, nil, streamHandlers, opts)
+	require.NoError(t, err)
+	mux, err := addon.createMux()
+	require.NoError(t, err)
+	addonServer := httptest.NewServer(mux)
+	defer addonServer.Close()
+
+	tests := []struct {
+		path               string
+		expectedTitle      string
+		expectedIsCinemeta string
+	}{
+		{"/stream/movie/tt1254207.json", "Movie tt1254207 (2008)", "true"},
+		{"/stream/series/kitsu:11:1.json", "Naruto S01E01 (2002-2007)", "false"},
+		{"/stream/movie/tmdb:123.json", "no meta", ""},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(addonServer.URL + tt.path)
+		require.NoError(t, err)
+		var body struct {
+			Streams []StreamItem `json:"streams"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Len(t, body.Streams, 1)
+		require.Equal(t, tt.expectedTitle, body.Streams[0].Title)
+		require.Equal(t, tt.expectedIsCinemeta, body.Streams[0].Name)
+	}
+
+	// Meta clients and providers can't be combined
+	opts.MetaClient = stubMetaFetcher{}
+	_, err = NewAddon(manifest, nil, streamHandlers, opts)
+	require.Error(t, err)
+}
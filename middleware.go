@@ -2,23 +2,35 @@ package stremio
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/Dasio/go-stremio/pkg/cinemeta"
 	"github.com/VictoriaMetrics/metrics"
 )
 
+// customMiddleware is a middleware that was added with Use() or UseFor().
 type customMiddleware struct {
-	path string
-	mw   http.Handler
+	// Name of the resource (like "stream") the middleware is scoped to. Empty for middlewares that apply to all requests.
+	resource string
+	mw       func(http.Handler) http.Handler
+}
+
+// resourceNames are the names that can be passed to UseFor().
+var resourceNames = []string{"manifest", "catalog", "stream", "meta", "subtitles", "addon_catalog"}
+
+// chainMiddlewares wraps the handler in the middlewares, with the first middleware being the outermost one.
+func chainMiddlewares(handler http.Handler, mws []func(http.Handler) http.Handler) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		handler = mws[i](handler)
+	}
+	return handler
 }
 
 func createSlogLoggingMiddleware(logger *slog.Logger, logIPs, logUserAgent, logMediaName bool, requiresUserData bool) func(http.Handler) http.Handler {
@@ -32,20 +44,13 @@ func createSlogLoggingMiddleware(logger *slog.Logger, logIPs, logUserAgent, logM
 				statusCode:     http.StatusOK,
 			}
 
-			// Call next handler
-			next.ServeHTTP(rw, r)
-
-			isStream := r.Context().Value("isStream") != nil
-
-			// Get meta from context - the meta middleware put it there.
-			var mediaName string
-			if logMediaName && isStream {
-				if meta, err := cinemeta.GetMetaFromContext(r.Context()); err != nil && err != cinemeta.ErrNoMeta {
-					logger.Error("Couldn't get meta from context", "error", err)
-				} else if err != cinemeta.ErrNoMeta {
-					mediaName = fmt.Sprintf("%v (%v)", meta.Name, meta.ReleaseInfo)
-				}
+			// Call next handler with a request info that the resource handlers and the meta middleware fill
+			info := getRequestInfo(r.Context())
+			if info == nil {
+				info = &requestInfo{}
+				r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
 			}
+			next.ServeHTTP(rw, r)
 
 			attrs := []any{
 				"status", rw.statusCode,
@@ -63,7 +68,8 @@ func createSlogLoggingMiddleware(logger *slog.Logger, logIPs, logUserAgent, logM
 			if logUserAgent {
 				attrs = append(attrs, "userAgent", r.UserAgent())
 			}
-			if logMediaName && isStream {
+			if logMediaName && info.resource == "stream" {
+				mediaName := info.mediaName
 				if mediaName == "" {
 					mediaName = "?"
 				}
@@ -75,20 +81,46 @@ func createSlogLoggingMiddleware(logger *slog.Logger, logIPs, logUserAgent, logM
 	}
 }
 
+// requestInfoKey is the context key for the *requestInfo.
+type requestInfoKey struct{}
+
+// requestInfo contains info about a resource request.
+// The logging or metrics middleware puts an empty one into the request context and the resource handlers and the meta middleware fill it,
+// so that the middlewares have access to the info after the request was handled.
+type requestInfo struct {
+	resource     string
+	typ          string
+	withUserData bool
+	// Name of the requested movie or TV show episode, set by the meta middleware if media name logging is enabled
+	mediaName string
+}
+
+// getRequestInfo returns the *requestInfo from the context or nil if there's none.
+func getRequestInfo(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
 func createMetricsMiddleware() func(http.Handler) http.Handler {
 	manifestRegex := regexp.MustCompile("^/.*/manifest.json$")
-	catalogRegex := regexp.MustCompile(`^/.*/catalog/.*/.*\.json`)
-	streamRegex := regexp.MustCompile(`^/.*/stream/.*/.*\.json`)
 
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
 			// Create response writer that captures status code
 			rw := &responseWriter{
 				ResponseWriter: w,
 				statusCode:     http.StatusOK,
 			}
 
-			// Call next handler
+			// Call next handler with a request info that the resource handlers fill.
+			// The logging middleware might have already put one into the context.
+			info := getRequestInfo(r.Context())
+			if info == nil {
+				info = &requestInfo{}
+				r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+			}
 			next.ServeHTTP(rw, r)
 
 			path := r.URL.Path
@@ -107,24 +139,17 @@ func createMetricsMiddleware() func(http.Handler) http.Handler {
 			}
 
 			if endpoint == "" {
-				if strings.HasPrefix(path, "/catalog") {
-					endpoint = "catalog"
-				} else if strings.HasPrefix(path, "/stream") {
-					endpoint = "stream"
+				if info.resource != "" {
+					endpoint = info.resource
+					if info.withUserData {
+						endpoint += "-data"
+					}
 				} else if strings.HasPrefix(path, "/configure") {
 					endpoint = "configure-other"
 				} else if strings.HasPrefix(path, "/debug/pprof") {
 					endpoint = "pprof"
-				}
-			}
-
-			if endpoint == "" {
-				if manifestRegex.MatchString(path) {
+				} else if manifestRegex.MatchString(path) {
 					endpoint = "manifest-data"
-				} else if catalogRegex.MatchString(path) {
-					endpoint = "catalog-data"
-				} else if streamRegex.MatchString(path) {
-					endpoint = "stream-data"
 				}
 			}
 
@@ -132,15 +157,31 @@ func createMetricsMiddleware() func(http.Handler) http.Handler {
 			if endpoint == "" {
 				endpoint = "other"
 			}
+			// The type is only set for types that the addon has handlers for, so there's no unbounded number of label values.
+			typ := info.typ
+			if typ == "" {
+				typ = "none"
+			}
 
 			// Total number of HTTP requests.
 			counterName := fmt.Sprintf(`http_requests_total{endpoint="%v", status="%v"}`, endpoint, rw.statusCode)
 			counter := metrics.GetOrCreateCounter(counterName)
 			counter.Add(1)
+
+			// Duration of HTTP requests.
+			histogramName := fmt.Sprintf(`http_request_duration_seconds{endpoint="%v",type="%v"}`, endpoint, typ)
+			metrics.GetOrCreateHistogram(histogramName).UpdateDuration(start)
 		})
 	}
 }
 
+// createMetricsHandler creates a handler that exposes the metrics in the Prometheus text format.
+func createMetricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.WritePrometheus(w, true)
+	}
+}
+
 func corsMiddleware() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -160,74 +201,89 @@ func corsMiddleware() func(http.Handler) http.Handler {
 	}
 }
 
-func createSlogMetaMiddleware(metaClient MetaFetcher, putMetaInHandlerContext, logMediaName bool, logger *slog.Logger) func(http.Handler) http.Handler {
+// mediaNameTimeout is the maximum duration of meta lookups that are only done for logging the media name.
+const mediaNameTimeout = 5 * time.Second
+
+// createMetaMiddleware creates a middleware that fetches the meta of the movie or TV show episode of a stream request from the meta provider.
+// Stremio sends IDs like "tt1254207" for movies and "tt0944947:1:2" (IMDb ID, season, episode) for TV show episodes.
+// Requests with IDs that the provider doesn't support are passed to the next handler without fetching meta.
+// If putMetaInContext is true, the meta is fetched before calling the next handler and put into the request context,
+// where handlers can get it with MetaFromContext().
+// Otherwise it's only needed for logging, so it's fetched concurrently with the next handler, without delaying the response.
+// In both cases the media name is stored in the request info for the logging middleware, if logMediaName is true.
+// If the concurrent lookup takes longer than the next handler, the media name is logged in a separate entry when it arrives.
+// If continueWithoutMeta is true, requests for which the meta couldn't be fetched are passed to the next handler without meta.
+func createMetaMiddleware(metaProvider MetaProvider, putMetaInContext, logMediaName, continueWithoutMeta bool, logger *slog.Logger) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// If we should put the meta in the context for *handlers* we get the meta synchronously.
-			// Otherwise we only need it for logging and can get the meta asynchronously.
-			if putMetaInHandlerContext {
-				putMetaInContext(r, metaClient, logger)
-				next.ServeHTTP(w, r)
-			} else if logMediaName {
-				var wg sync.WaitGroup
-				wg.Add(1)
+			// Type and ID can never be empty, because the router only matches requests that contain both
+			t := r.PathValue("type")
+			id := r.PathValue("id")
+
+			if !putMetaInContext {
+				var lock sync.Mutex
+				var responded, finished bool
+				var meta MediaMeta
+				var err error
 				go func() {
-					putMetaInContext(r, metaClient, logger)
-					wg.Done()
+					// The lookup can outlive the request, but not indefinitely
+					ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), mediaNameTimeout)
+					defer cancel()
+					m, e := metaProvider.GetMeta(ctx, t, id)
+					lock.Lock()
+					defer lock.Unlock()
+					if !responded {
+						meta, err, finished = m, e, true
+						return
+					}
+					// The request was already logged, so the media name gets its own log entry
+					if e != nil && !errors.Is(e, ErrUnsupportedID) {
+						logger.Warn("Couldn't get meta for logging the media name", "error", e, "type", t, "id", id)
+					} else if e == nil {
+						logger.Info("Got media name after responding", "mediaName", m.displayName(), "type", t, "id", id)
+					}
 				}()
 				next.ServeHTTP(w, r)
-				// Wait so that the meta is in the context when returning to the logging middleware
-				wg.Wait()
-			} else {
+				// Don't delay the response for logging, but if the lookup was faster than the handler, the name is part of the request's log entry
+				lock.Lock()
+				defer lock.Unlock()
+				responded = true
+				if finished && err != nil && !errors.Is(err, ErrUnsupportedID) {
+					logger.Warn("Couldn't get meta for logging the media name", "error", err, "type", t, "id", id)
+				} else if finished && err == nil {
+					setMediaName(r.Context(), meta)
+				}
+				return
+			}
+
+			meta, err := metaProvider.GetMeta(r.Context(), t, id)
+			if errors.Is(err, ErrUnsupportedID) {
 				next.ServeHTTP(w, r)
+				return
+			} else if err != nil {
+				if continueWithoutMeta {
+					logger.Warn("Couldn't get meta, continuing without it", "error", err, "type", t, "id", id)
+					next.ServeHTTP(w, r)
+				} else if errors.Is(err, errInvalidMediaID) {
+					writeError(w, http.StatusBadRequest, "Invalid ID")
+				} else {
+					logger.Error("Couldn't get meta", "error", err, "type", t, "id", id)
+					writeError(w, http.StatusInternalServerError, "Failed to get meta information")
+				}
+				return
+			}
+			logger.Debug("Got meta", "meta", fmt.Sprintf("%+v", meta))
+			if logMediaName {
+				setMediaName(r.Context(), meta)
 			}
+			next.ServeHTTP(w, r.WithContext(newMetaContext(r.Context(), meta)))
 		})
 	}
 }
 
-func putMetaInContext(r *http.Request, metaClient MetaFetcher, logger *slog.Logger) {
-	var meta cinemeta.Meta
-	var err error
-	// type and id can never be empty, because that's been checked by a previous middleware
-	t := r.URL.Query().Get("type")
-	id := r.URL.Query().Get("id")
-	id, err = url.PathUnescape(id)
-	if err != nil {
-		logger.Error("ID in URL parameters couldn't be unescaped", "id", id)
-		return
+// setMediaName stores the name of the movie or TV show episode in the request info, like "Big Buck Bunny (2008)" or "Game of Thrones S01E02 (2011-2019)".
+func setMediaName(ctx context.Context, meta MediaMeta) {
+	if info := getRequestInfo(ctx); info != nil {
+		info.mediaName = meta.displayName()
 	}
-
-	switch t {
-	case "movie":
-		meta, err = metaClient.GetMovie(r.Context(), id)
-		if err != nil {
-			logger.Error("Couldn't get movie info with MetaFetcher", "error", err)
-			return
-		}
-	case "series":
-		splitID := strings.Split(id, ":")
-		if len(splitID) != 3 {
-			logger.Warn("No 3 elements after splitting TV show ID by \":\"", "id", id)
-			return
-		}
-		season, err := strconv.Atoi(splitID[1])
-		if err != nil {
-			logger.Warn("Can't parse season as int", "season", splitID[1])
-			return
-		}
-		episode, err := strconv.Atoi(splitID[2])
-		if err != nil {
-			logger.Warn("Can't parse episode as int", "episode", splitID[2])
-			return
-		}
-		meta, err = metaClient.GetTVShow(r.Context(), splitID[0], season, episode)
-		if err != nil {
-			logger.Error("Couldn't get TV show info with MetaFetcher", "error", err)
-			return
-		}
-	}
-
-	logger.Debug("Got meta from cinemata client", "meta", fmt.Sprintf("%+v", meta))
-	ctx := context.WithValue(r.Context(), "meta", meta)
-	r = r.WithContext(ctx)
 }
@@ -0,0 +1,63 @@
+package cinemeta
+
+import (
+	"sync"
+	"time"
+)
+
+// circuitBreaker stops requests to Cinemeta after too many consecutive failures.
+// After the cooldown it lets a single trial request through: If it succeeds, the breaker closes again, otherwise it stays open for another cooldown.
+type circuitBreaker struct {
+	// Number of consecutive failures after which the breaker opens. <= 0 disables the breaker.
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	// True while the trial request of a half-open breaker is running
+	trial bool
+	lock  *sync.Mutex
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		lock:      &sync.Mutex{},
+	}
+}
+
+// allow reports whether a request may be sent.
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Since(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// success records a successful request and closes the breaker.
+func (b *circuitBreaker) success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.trial = false
+}
+
+// failure records a failed request and opens the breaker if the threshold is reached.
+func (b *circuitBreaker) failure() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.trial = false
+	if b.failures >= b.threshold {
+		b.openedAt = time.Now()
+	}
+}
@@ -1,6 +1,7 @@
 package cinemeta
 
 import (
+	"container/list"
 	"sync"
 	"time"
 )
@@ -14,9 +15,9 @@ type CacheItem struct {
 }
 
 // Cache is the interface that the cinemeta client uses for caching meta.
-// A package user must pass an implementation of this interface.
-// Usually you create a simple wrapper around an existing cache package.
-// An example implementation is the InMemoryCache in this package.
+// If you don't pass an implementation of this interface to NewClient, the client uses an LRUCache.
+// For other backends you usually create a simple wrapper around an existing cache package.
+// Example implementations are the InMemoryCache and LRUCache in this package.
 type Cache interface {
 	Set(key string, movie Meta) error
 	Get(key string) (Meta, time.Time, bool, error)
@@ -25,7 +26,8 @@ type Cache interface {
 var _ Cache = (*InMemoryCache)(nil)
 
 // InMemoryCache is an example implementation of the Cache interface.
-// It doesn't persist its data, so it's not suited for production use of the cinemeta package.
+// It doesn't persist its data and never removes items, so it's not suited for production use of the cinemeta package.
+// Use LRUCache for a bounded in-memory cache.
 type InMemoryCache struct {
 	cache map[string]CacheItem
 	lock  *sync.RWMutex
@@ -58,3 +60,158 @@ func (c *InMemoryCache) Get(key string) (Meta, time.Time, bool, error) {
 	cacheItem, found := c.cache[key]
 	return cacheItem.Meta, cacheItem.Created, found, nil
 }
+
+var _ Cache = (*LRUCache)(nil)
+
+// CacheStats contains statistics about the usage of a cache.
+type CacheStats struct {
+	// Number of Get calls that found an item
+	Hits uint64
+	// Number of Get calls that didn't find an item
+	Misses uint64
+	// Number of items that were removed because the cache was full
+	Evictions uint64
+	// Number of items that were removed because they were older than the TTL
+	Expirations uint64
+}
+
+// lruItem is an element of the LRUCache's list.
+type lruItem struct {
+	key string
+	CacheItem
+}
+
+// LRUCache is an in-memory implementation of the Cache interface with a maximum number of items.
+// When it's full, the least recently used item is evicted.
+// Items that are older than the TTL are removed in the background.
+// Call Close() when you don't need the cache anymore, to stop the background expiry.
+type LRUCache struct {
+	size  int
+	ttl   time.Duration
+	items map[string]*list.Element
+	// Most recently used items are at the front
+	order *list.List
+	stats CacheStats
+	lock  *sync.Mutex
+	stop  chan struct{}
+	once  *sync.Once
+}
+
+// NewLRUCache creates a new LRUCache that holds at most size items and removes items older than ttl in the background.
+// The background expiry runs every minute, or in the interval of the TTL if it's shorter.
+// A size <= 0 leads to a size of 1. A TTL <= 0 disables the background expiry.
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	if size <= 0 {
+		size = 1
+	}
+	c := &LRUCache{
+		size:  size,
+		ttl:   ttl,
+		items: map[string]*list.Element{},
+		order: list.New(),
+		lock:  &sync.Mutex{},
+		stop:  make(chan struct{}),
+		once:  &sync.Once{},
+	}
+	if ttl > 0 {
+		go c.expire(min(ttl, time.Minute))
+	}
+	return c
+}
+
+// Set stores a meta object and the current time in the cache and evicts the least recently used item if the cache is full.
+func (c *LRUCache) Set(key string, meta Meta) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cacheItem := CacheItem{
+		Meta:    meta,
+		Created: time.Now(),
+	}
+	if elem, ok := c.items[key]; ok {
+		elem.Value.(*lruItem).CacheItem = cacheItem
+		c.order.MoveToFront(elem)
+		return nil
+	}
+	c.items[key] = c.order.PushFront(&lruItem{key: key, CacheItem: cacheItem})
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.stats.Evictions++
+	}
+	return nil
+}
+
+// Get returns a meta object and the time it was cached from the cache.
+// The boolean return value signals if the value was found in the cache.
+func (c *LRUCache) Get(key string) (Meta, time.Time, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return Meta{}, time.Time{}, false, nil
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(elem)
+	cacheItem := elem.Value.(*lruItem).CacheItem
+	return cacheItem.Meta, cacheItem.Created, true, nil
+}
+
+// Len returns the number of items in the cache.
+func (c *LRUCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// Stats returns the hit, miss, eviction and expiration counts of the cache.
+func (c *LRUCache) Stats() CacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Close stops the background expiry. The cache can still be used afterwards, but expired items are only replaced and not removed.
+func (c *LRUCache) Close() {
+	c.once.Do(func() {
+		close(c.stop)
+	})
+}
+
+// expire removes expired items in the given interval until the cache is closed.
+func (c *LRUCache) expire(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.removeExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// removeExpired removes all items that are older than the TTL.
+func (c *LRUCache) removeExpired() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Items that were set earlier are further at the back, but using an item moves it to the front,
+	// so we have to check all of them.
+	for elem := c.order.Back(); elem != nil; {
+		prev := elem.Prev()
+		if time.Since(elem.Value.(*lruItem).Created) > c.ttl {
+			c.remove(elem)
+			c.stats.Expirations++
+		}
+		elem = prev
+	}
+}
+
+// remove removes the element from the list and map. The lock must be held.
+func (c *LRUCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*lruItem).key)
+}
@@ -0,0 +1,161 @@
+package cinemeta
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache(t *testing.T) {
+	t.Run("eviction", func(t *testing.T) {
+		cache := NewLRUCache(2, time.Hour)
+		defer cache.Close()
+
+		require.NoError(t, cache.Set("tt1", Meta{ID: "tt1"}))
+		require.NoError(t, cache.Set("tt2", Meta{ID: "tt2"}))
+		// Use "tt1" so that "tt2" is the least recently used item
+		meta, _, found, err := cache.Get("tt1")
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, "tt1", meta.ID)
+		require.NoError(t, cache.Set("tt3", Meta{ID: "tt3"}))
+
+		require.Equal(t, 2, cache.Len())
+		_, _, found, _ = cache.Get("tt2")
+		require.False(t, found)
+		_, _, found, _ = cache.Get("tt3")
+		require.True(t, found)
+
+		require.Equal(t, CacheStats{Hits: 2, Misses: 1, Evictions: 1}, cache.Stats())
+	})
+
+	t.Run("update", func(t *testing.T) {
+		cache := NewLRUCache(2, time.Hour)
+		defer cache.Close()
+
+		require.NoError(t, cache.Set("tt1", Meta{Name: "foo"}))
+		require.NoError(t, cache.Set("tt1", Meta{Name: "bar"}))
+		require.Equal(t, 1, cache.Len())
+		meta, created, found, err := cache.Get("tt1")
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, "bar", meta.Name)
+		require.WithinDuration(t, time.Now(), created, time.Second)
+	})
+
+	t.Run("background expiry", func(t *testing.T) {
+		cache := NewLRUCache(10, 50*time.Millisecond)
+		defer cache.Close()
+
+		require.NoError(t, cache.Set("tt1", Meta{ID: "tt1"}))
+		require.Eventually(t, func() bool {
+			return cache.Len() == 0
+		}, time.Second, 10*time.Millisecond)
+		require.EqualValues(t, 1, cache.Stats().Expirations)
+	})
+
+	t.Run("remove expired", func(t *testing.T) {
+		cache := NewLRUCache(10, time.Hour)
+		defer cache.Close()
+
+		require.NoError(t, cache.Set("tt1", Meta{ID: "tt1"}))
+		require.NoError(t, cache.Set("tt2", Meta{ID: "tt2"}))
+		cache.items["tt1"].Value.(*lruItem).Created = time.Now().Add(-2 * time.Hour)
+		cache.removeExpired()
+
+		_, _, found, _ := cache.Get("tt1")
+		require.False(t, found)
+		_, _, found, _ = cache.Get("tt2")
+		require.True(t, found)
+	})
+}
+
+func TestFileCache(t *testing.T) {
+	t.Run("persistence", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cinemeta.jsonl")
+		cache, err := NewFileCache(path, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, cache.Set("tt1254207", Meta{ID: "tt1254207", Name: "Big Buck Bunny"}))
+		require.NoError(t, cache.Set("tt0944947", Meta{ID: "tt0944947", Name: "Game of Thrones"}))
+		require.NoError(t, cache.Close())
+
+		cache, err = NewFileCache(path, time.Hour)
+		require.NoError(t, err)
+		defer cache.Close()
+		require.Equal(t, 2, cache.Len())
+		meta, created, found, err := cache.Get("tt1254207")
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, "Big Buck Bunny", meta.Name)
+		require.WithinDuration(t, time.Now(), created, time.Minute)
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cinemeta.jsonl")
+		cache, err := NewFileCache(path, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, cache.Set("tt1254207", Meta{ID: "tt1254207"}))
+		require.NoError(t, cache.Close())
+
+		// Expired items aren't loaded
+		cache, err = NewFileCache(path, time.Nanosecond)
+		require.NoError(t, err)
+		defer cache.Close()
+		require.Equal(t, 0, cache.Len())
+	})
+
+	t.Run("compaction", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cinemeta.jsonl")
+		cache, err := NewFileCache(path, time.Hour)
+		require.NoError(t, err)
+		defer cache.Close()
+
+		// Overwrite the same items until the automatic compaction kicks in
+		for i := range minCompactionRecords {
+			require.NoError(t, cache.Set("tt"+strconv.Itoa(i%10), Meta{Name: strconv.Itoa(i)}))
+		}
+		require.Equal(t, 10, countLines(t, path))
+		meta, _, found, err := cache.Get("tt9")
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, strconv.Itoa(minCompactionRecords-1), meta.Name)
+
+		// Appending still works after the compaction
+		require.NoError(t, cache.Set("tt1254207", Meta{ID: "tt1254207"}))
+		require.Equal(t, 11, countLines(t, path))
+	})
+
+	t.Run("interrupted write", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "cinemeta.jsonl")
+		cache, err := NewFileCache(path, time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, cache.Set("tt1254207", Meta{ID: "tt1254207"}))
+		require.NoError(t, cache.Close())
+
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+		require.NoError(t, err)
+		_, err = f.WriteString(`{"key":"tt09`)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		cache, err = NewFileCache(path, time.Hour)
+		require.NoError(t, err)
+		defer cache.Close()
+		require.Equal(t, 1, cache.Len())
+		require.NoError(t, cache.Set("tt0944947", Meta{ID: "tt0944947"}))
+		require.Equal(t, 2, countLines(t, path))
+	})
+}
+
+// countLines returns the number of lines in the file.
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Count(string(data), "\n")
+}
@@ -3,13 +3,37 @@ package cinemeta
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"strconv"
 	"time"
+
+	"github.com/Dasio/go-stremio/internal/singleflight"
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// Counters for the results of cache lookups in getMeta.
+// They're exposed by go-stremio at "/metrics" when metrics are enabled.
+var (
+	cacheHits    = metrics.NewCounter(`cinemeta_cache_requests_total{result="hit"}`)
+	cacheMisses  = metrics.NewCounter(`cinemeta_cache_requests_total{result="miss"}`)
+	cacheExpired = metrics.NewCounter(`cinemeta_cache_requests_total{result="expired"}`)
+	// Also counts the IDs that are known to not exist in Cinemeta
+	cacheNotFound = metrics.NewCounter(`cinemeta_cache_requests_total{result="not_found"}`)
+	// Counts the calls that failed fast because of an open circuit breaker
+	circuitOpen = metrics.NewCounter(`cinemeta_circuit_open_total`)
 )
 
+// ErrNotFound signals that Cinemeta doesn't have meta for the requested ID.
+var ErrNotFound = errors.New("meta not found in Cinemeta")
+
+// ErrCircuitOpen signals that the request wasn't sent, because too many previous requests to Cinemeta failed.
+var ErrCircuitOpen = errors.New("Cinemeta circuit breaker is open")
+
 // ClientOptions are the options for the Cinemeta client.
 type ClientOptions struct {
 	// The base URL for Cinemeta.
@@ -18,19 +42,56 @@ type ClientOptions struct {
 	// Timeout for requests.
 	// A more customizable cancellation can be achieved with the context,
 	// but it can never be *longer* than this timeout.
+	// All retries of a request together are limited to MaxRetries+1 times this timeout plus MaxRetries times RetryMaxDelay.
 	// Default 2 seconds.
 	Timeout time.Duration
 	// Max age of items in the cache.
 	// Default 30 days.
 	TTL time.Duration
+	// Max number of items in the LRUCache that NewClient creates if no cache is passed.
+	// Default 10000.
+	CacheSize int
+	// Max number of retries of requests that failed with a transient error,
+	// like a network error, a timeout, "429 Too Many Requests" or a 5xx status code.
+	// Default 2. A negative value disables retries.
+	MaxRetries int
+	// Delay before the first retry. It doubles with each retry, up to RetryMaxDelay, and is randomized by up to 50%
+	// so that many clients don't retry at the same time.
+	// A longer delay requested by Cinemeta in a Retry-After header takes precedence, up to RetryMaxDelay.
+	// Default 100 milliseconds.
+	RetryBaseDelay time.Duration
+	// Max delay between retries. If Cinemeta requests a longer one in a Retry-After header,
+	// the client doesn't retry and returns the error instead.
+	// Default 2 seconds.
+	RetryMaxDelay time.Duration
+	// Number of consecutive failed requests (after retries) after which the client stops sending requests
+	// and fails fast with ErrCircuitOpen for the BreakerCooldown.
+	// Default 5. A negative value disables the circuit breaker.
+	BreakerThreshold int
+	// Time after which the client lets a trial request through when the circuit breaker is open.
+	// If it succeeds, the breaker closes again.
+	// Default 30 seconds.
+	BreakerCooldown time.Duration
+	// Time during which IDs that Cinemeta responded to with "404 Not Found" aren't requested again.
+	// The client returns ErrNotFound for them.
+	// Default 10 minutes. A negative value disables the caching of not found IDs.
+	NotFoundTTL time.Duration
 }
 
 // DefaultClientOpts is an options object with sensible defaults.
 var DefaultClientOpts = ClientOptions{
 	BaseURL: "https://v3-cinemeta.strem.io",
 	// HTTP client timeout
-	Timeout: 2 * time.Second,
-	TTL:     30 * 24 * time.Hour, // 30 days
+	Timeout:        2 * time.Second,
+	TTL:            30 * 24 * time.Hour, // 30 days
+	CacheSize:      10000,
+	MaxRetries:     2,
+	RetryBaseDelay: 100 * time.Millisecond,
+	RetryMaxDelay:  2 * time.Second,
+	// Circuit breaker and negative caching
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+	NotFoundTTL:      10 * time.Minute,
 }
 
 // Client is the Cinemeta client.
@@ -40,9 +101,19 @@ type Client struct {
 	cache      Cache
 	logger     *slog.Logger
 	ttl        time.Duration
+	// Deduplicates concurrent requests for the same meta
+	inflight       singleflight.Group[Meta]
+	maxRetries     int
+	retryBaseDelay time.Duration
+	retryMaxDelay  time.Duration
+	breaker        *circuitBreaker
+	notFound       *notFoundCache
+	// The cache that NewClient created because none was passed, closed by Close()
+	ownCache *LRUCache
 }
 
 // NewClient creates a new Cinemeta client.
+// If cache is nil, the client uses an LRUCache with the CacheSize and TTL of the options.
 func NewClient(opts ClientOptions, cache Cache, logger *slog.Logger) *Client {
 	// Set defaults if necessary.
 	// A TTL of 0 is allowed.
@@ -55,15 +126,58 @@ func NewClient(opts ClientOptions, cache Cache, logger *slog.Logger) *Client {
 	if opts.TTL == 0 {
 		opts.TTL = DefaultClientOpts.TTL
 	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = DefaultClientOpts.CacheSize
+	}
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = DefaultClientOpts.MaxRetries
+	} else if opts.MaxRetries < 0 {
+		opts.MaxRetries = 0
+	}
+	if opts.RetryBaseDelay == 0 {
+		opts.RetryBaseDelay = DefaultClientOpts.RetryBaseDelay
+	}
+	if opts.RetryMaxDelay == 0 {
+		opts.RetryMaxDelay = DefaultClientOpts.RetryMaxDelay
+	}
+	if opts.BreakerThreshold == 0 {
+		opts.BreakerThreshold = DefaultClientOpts.BreakerThreshold
+	}
+	if opts.BreakerCooldown == 0 {
+		opts.BreakerCooldown = DefaultClientOpts.BreakerCooldown
+	}
+	if opts.NotFoundTTL == 0 {
+		opts.NotFoundTTL = DefaultClientOpts.NotFoundTTL
+	}
+	var ownCache *LRUCache
+	if cache == nil {
+		ownCache = NewLRUCache(opts.CacheSize, opts.TTL)
+		cache = ownCache
+	}
 
 	return &Client{
 		baseURL: opts.BaseURL,
 		httpClient: &http.Client{
 			Timeout: opts.Timeout,
 		},
-		cache:  cache,
-		logger: logger,
-		ttl:    opts.TTL,
+		cache:          cache,
+		logger:         logger,
+		ttl:            opts.TTL,
+		maxRetries:     opts.MaxRetries,
+		retryBaseDelay: opts.RetryBaseDelay,
+		retryMaxDelay:  opts.RetryMaxDelay,
+		breaker:        newCircuitBreaker(opts.BreakerThreshold, opts.BreakerCooldown),
+		notFound:       newNotFoundCache(opts.NotFoundTTL, opts.CacheSize),
+		ownCache:       ownCache,
+	}
+}
+
+// Close stops the background expiry of the LRUCache that NewClient created if no cache was passed.
+// A cache that was passed to NewClient isn't closed, because the caller owns it.
+// The client can still be used afterwards, but expired items are only replaced and not removed.
+func (c *Client) Close() {
+	if c.ownCache != nil {
+		c.ownCache.Close()
 	}
 }
 
@@ -73,70 +187,201 @@ func NewClient(opts ClientOptions, cache Cache, logger *slog.Logger) *Client {
 // than the HTTP client's configured timeout then it takes precedence.
 // If no timeout is set in the context, the HTTP client's timeout takes effect.
 func (c *Client) GetMovie(ctx context.Context, imdbID string) (Meta, error) {
-	return c.getMeta(ctx, movie, imdbID, 0, 0)
+	return c.getMeta(ctx, movie, imdbID)
 }
 
-// GetTVShow returns the meta object either from the cache or from Cinemeta.
-// It automatically fills the cache with new Cinemeta responses.
+// GetTVShow returns the meta object either from the cache or from Cinemeta, with the requested episode in its Episode field.
+// The Episode is nil if Cinemeta doesn't know the episode (yet).
+// It automatically fills the cache with new Cinemeta responses. The TV show is cached once for all of its episodes.
 // The context can control the lifetime of the request, and if for example the timeout is shorter
 // than the HTTP client's configured timeout then it takes precedence.
 // If no timeout is set in the context, the HTTP client's timeout takes effect.
 func (c *Client) GetTVShow(ctx context.Context, imdbID string, season int, episode int) (Meta, error) {
-	return c.getMeta(ctx, tvShow, imdbID, season, episode)
+	meta, err := c.getMeta(ctx, tvShow, imdbID)
+	if err != nil {
+		return Meta{}, err
+	}
+	if video, ok := meta.FindEpisode(season, episode); ok {
+		meta.Episode = &video
+	} else {
+		c.logger.Debug("Episode not found in meta", "imdbID", fmt.Sprintf("%v:%v:%v", imdbID, season, episode))
+	}
+	return meta, nil
+}
+
+// GetSeries returns the meta object of a TV show either from the cache or from Cinemeta, without looking up an episode.
+// It's useful for IDs that refer to a whole TV show, like the ones in catalogs. The Episode is always nil.
+// The TV show is cached once for GetSeries and GetTVShow.
+// The context can control the lifetime of the request like with GetTVShow.
+func (c *Client) GetSeries(ctx context.Context, imdbID string) (Meta, error) {
+	return c.getMeta(ctx, tvShow, imdbID)
 }
 
-// GetMeta returns the meta object either from the cache or from Cinemeta.
+// getMeta returns the meta object either from the cache or from Cinemeta.
 // It automatically fills the cache with new Cinemeta responses.
-// The context can control the lifetime of the request, and if for example the timeout is shorter
+// The cache keys are prefixed with the type (like "series:tt0944947"), because Cinemeta could use the same ID for different types.
+// Concurrent calls for the same meta share one Cinemeta request.
+// The context can control how long the call waits for the request, and if for example the timeout is shorter
 // than the HTTP client's configured timeout then it takes precedence.
+// The request itself continues in the background in that case, so that other callers and the cache still get its result.
 // If no timeout is set in the context, the HTTP client's timeout takes effect.
-func (c *Client) getMeta(ctx context.Context, t mediaType, imdbID string, season int, episode int) (Meta, error) {
-	var logIMDbID string
-	switch t {
-	case movie:
-		logIMDbID = imdbID
-	case tvShow:
-		logIMDbID = fmt.Sprintf("%v:%v:%v", imdbID, season, episode)
-	}
+func (c *Client) getMeta(ctx context.Context, t mediaType, imdbID string) (Meta, error) {
+	cacheKey := t.stremioType() + ":" + imdbID
 
 	// Check cache first
-	meta, created, found, err := c.cache.Get(imdbID)
+	meta, created, found, err := c.cache.Get(cacheKey)
 	if err != nil {
-		c.logger.Error("Couldn't decode meta", "error", err, "imdbID", logIMDbID)
+		c.logger.Error("Couldn't decode meta", "error", err, "imdbID", imdbID)
 	} else if !found {
-		c.logger.Debug("Meta not found in cache", "imdbID", logIMDbID)
+		cacheMisses.Inc()
+		c.logger.Debug("Meta not found in cache", "imdbID", imdbID)
 	} else if time.Since(created) > c.ttl {
+		cacheExpired.Inc()
 		expiredSince := time.Since(created.Add(c.ttl))
-		c.logger.Debug("Hit cache for meta, but item is expired", "expiredSince", expiredSince, "imdbID", logIMDbID)
+		c.logger.Debug("Hit cache for meta, but item is expired", "expiredSince", expiredSince, "imdbID", imdbID)
 	} else {
+		cacheHits.Inc()
 		c.logger.Debug("Hit cache for meta, returning result")
 		return meta, nil
 	}
-
-	var reqUrl string
-	switch t {
-	case movie:
-		reqUrl = c.baseURL + "/meta/movie/" + imdbID + ".json"
-	case tvShow:
-		reqUrl = c.baseURL + "/meta/series/" + imdbID + ".json"
+	if c.notFound.contains(cacheKey) {
+		cacheNotFound.Inc()
+		return Meta{}, ErrNotFound
+	}
+	if !c.breaker.allow() {
+		circuitOpen.Inc()
+		return Meta{}, ErrCircuitOpen
 	}
 
 	// Then check web service
+	type result struct {
+		meta Meta
+		err  error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		meta, err, _ := c.inflight.Do(cacheKey, func() (Meta, error) {
+			// The request is shared, so it must not be canceled when the first caller's context is done
+			meta, err := c.fetchMeta(context.WithoutCancel(ctx), t, imdbID, cacheKey)
+			var transientErr *transientError
+			if errors.As(err, &transientErr) {
+				c.breaker.failure()
+			} else {
+				// Permanent errors like ErrNotFound mean that Cinemeta is up
+				c.breaker.success()
+			}
+			if errors.Is(err, ErrNotFound) {
+				c.notFound.add(cacheKey)
+			}
+			return meta, err
+		})
+		resultChan <- result{meta, err}
+	}()
+	select {
+	case res := <-resultChan:
+		return res.meta, res.err
+	case <-ctx.Done():
+		return Meta{}, ctx.Err()
+	}
+}
+
+// transientError is an error that might not occur again when retrying the request.
+type transientError struct {
+	err error
+	// Delay that Cinemeta requested in a Retry-After header
+	retryAfter time.Duration
+}
+
+func (e *transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transientError) Unwrap() error {
+	return e.err
+}
+
+// fetchMeta requests the meta object from Cinemeta, retries transient errors and fills the cache.
+func (c *Client) fetchMeta(ctx context.Context, t mediaType, imdbID string, cacheKey string) (Meta, error) {
+	// The request is shared by all callers and the circuit breaker waits for its outcome,
+	// so the attempts and the delays between them must not take longer than they're configured to
+	budget := time.Duration(c.maxRetries+1)*c.httpClient.Timeout + time.Duration(c.maxRetries)*c.retryMaxDelay
+	ctx, cancel := context.WithTimeout(ctx, budget)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		meta, err := c.requestMeta(ctx, t, imdbID)
+		var transientErr *transientError
+		if err != nil && errors.As(err, &transientErr) && attempt < c.maxRetries {
+			if transientErr.retryAfter > c.retryMaxDelay {
+				c.logger.Debug("Not retrying Cinemeta request, the requested delay is too long", "error", err, "retryAfter", transientErr.retryAfter, "imdbID", imdbID)
+				return Meta{}, err
+			}
+			delay := max(c.backoff(attempt), transientErr.retryAfter)
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+				c.logger.Debug("Not retrying Cinemeta request, the delay exceeds the timeout", "error", err, "delay", delay, "imdbID", imdbID)
+				return Meta{}, err
+			}
+			c.logger.Debug("Retrying Cinemeta request", "error", err, "delay", delay, "imdbID", imdbID)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+				return Meta{}, err
+			}
+		} else if err != nil {
+			return Meta{}, err
+		}
+
+		// Fill cache
+		if err = c.cache.Set(cacheKey, meta); err != nil {
+			c.logger.Error("Couldn't cache meta", "error", err, "meta", fmt.Sprintf("%+v", meta), "imdbID", imdbID)
+		}
+		return meta, nil
+	}
+}
+
+// backoff returns the delay before the retry after the given attempt (starting at 0),
+// which grows exponentially and is randomized by up to 50%.
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.retryMaxDelay
+	if attempt < 32 {
+		delay = min(c.retryBaseDelay<<attempt, c.retryMaxDelay)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// requestMeta sends a single request for the meta object to Cinemeta.
+// Errors that might not occur again when retrying are of type *transientError.
+func (c *Client) requestMeta(ctx context.Context, t mediaType, imdbID string) (Meta, error) {
+	reqUrl := c.baseURL + "/meta/" + t.stremioType() + "/" + imdbID + ".json"
 	req, err := http.NewRequestWithContext(ctx, "GET", reqUrl, nil)
 	if err != nil {
 		return Meta{}, fmt.Errorf("Couldn't create request: %v", err)
 	}
 	res, err := c.httpClient.Do(req)
 	if err != nil {
-		return Meta{}, fmt.Errorf("Couldn't GET %v: %v", reqUrl, err)
+		// Network errors and timeouts are transient, unless the caller canceled the request
+		err = fmt.Errorf("Couldn't GET %v: %w", reqUrl, err)
+		if ctx.Err() != nil {
+			return Meta{}, err
+		}
+		return Meta{}, &transientError{err: err}
 	}
 	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		return Meta{}, fmt.Errorf("Bad GET response: %v", res.StatusCode)
+	if res.StatusCode == http.StatusNotFound {
+		return Meta{}, ErrNotFound
+	} else if res.StatusCode != http.StatusOK {
+		err := fmt.Errorf("Bad GET response: %v", res.StatusCode)
+		if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+			return Meta{}, &transientError{err: err, retryAfter: parseRetryAfter(res.Header.Get("Retry-After"))}
+		}
+		return Meta{}, err
 	}
 	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		return Meta{}, fmt.Errorf("Couldn't read response body: %v", err)
+		return Meta{}, &transientError{err: fmt.Errorf("Couldn't read response body: %w", err)}
 	}
 	cineRes := cinemetaResponse{}
 	if err := json.Unmarshal(resBody, &cineRes); err != nil {
@@ -145,11 +390,20 @@ func (c *Client) getMeta(ctx context.Context, t mediaType, imdbID string, season
 	if cineRes.Meta.Name == "" {
 		return Meta{}, fmt.Errorf("Couldn't find %v name in Cinemeta response", t)
 	}
+	return cineRes.Meta, nil
+}
 
-	// Fill cache
-	if err = c.cache.Set(imdbID, cineRes.Meta); err != nil {
-		c.logger.Error("Couldn't cache meta", "error", err, "meta", fmt.Sprintf("%+v", cineRes.Meta), "imdbID", logIMDbID)
+// parseRetryAfter parses the value of a Retry-After header, which can be a number of seconds or an HTTP date.
+// It returns 0 if the value is empty or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
 	}
-
-	return cineRes.Meta, nil
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
 }
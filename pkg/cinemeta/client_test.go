@@ -0,0 +1,311 @@
+package cinemeta
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newTestServer creates a Cinemeta stand-in that serves a movie and a TV show with the same ID.
+// The returned counter contains the number of requests.
+func newTestServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/meta/movie/tt0000001.json", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, `{"meta":{"id":"tt0000001","type":"movie","name":"A movie"}}`)
+	})
+	mux.HandleFunc("/meta/series/tt0000001.json", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		io.WriteString(w, `{"meta":{"id":"tt0000001","type":"series","name":"A TV show","videos":[
+			{"id":"tt0000001:1:1","name":"Pilot","season":1,"episode":1,"released":"2011-04-17T02:00:00.000Z","thumbnail":"https://example.com/1.jpg"},
+			{"id":"tt0000001:1:2","title":"The Second One","season":1,"episode":2}
+		]}}`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func newTestClient(t *testing.T, opts ClientOptions) *Client {
+	t.Helper()
+	cache := NewLRUCache(10, 0)
+	t.Cleanup(cache.Close)
+	return NewClient(opts, cache, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestGetTVShow(t *testing.T) {
+	server, requests := newTestServer(t)
+	client := newTestClient(t, ClientOptions{BaseURL: server.URL})
+	ctx := context.Background()
+
+	meta, err := client.GetTVShow(ctx, "tt0000001", 1, 1)
+	require.NoError(t, err)
+	require.Equal(t, "A TV show", meta.Name)
+	require.Len(t, meta.Videos, 2)
+	require.NotNil(t, meta.Episode)
+	require.Equal(t, "Pilot", meta.Episode.Name)
+	require.Equal(t, "2011-04-17T02:00:00.000Z", meta.Episode.Released)
+	require.Equal(t, "https://example.com/1.jpg", meta.Episode.Thumbnail)
+
+	// Other episodes are answered from the cached TV show
+	meta, err = client.GetTVShow(ctx, "tt0000001", 1, 2)
+	require.NoError(t, err)
+	require.NotNil(t, meta.Episode)
+	require.Equal(t, "The Second One", meta.Episode.Title)
+	require.EqualValues(t, 1, requests.Load())
+
+	// Unknown episodes don't lead to an error
+	meta, err = client.GetTVShow(ctx, "tt0000001", 2, 1)
+	require.NoError(t, err)
+	require.Equal(t, "A TV show", meta.Name)
+	require.Nil(t, meta.Episode)
+	require.EqualValues(t, 1, requests.Load())
+
+	// So is the TV show without an episode
+	meta, err = client.GetSeries(ctx, "tt0000001")
+	require.NoError(t, err)
+	require.Equal(t, "A TV show", meta.Name)
+	require.Len(t, meta.Videos, 2)
+	require.Nil(t, meta.Episode)
+	require.EqualValues(t, 1, requests.Load())
+}
+
+func TestClose(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// The cache that the client created is closed
+	client := NewClient(ClientOptions{}, nil, logger)
+	require.NotNil(t, client.ownCache)
+	client.Close()
+	require.NotPanics(t, client.Close)
+	select {
+	case <-client.ownCache.stop:
+	default:
+		t.Fatal("the client's cache wasn't closed")
+	}
+
+	// A passed cache is left to its owner
+	cache := NewLRUCache(10, time.Hour)
+	defer cache.Close()
+	client = NewClient(ClientOptions{}, cache, logger)
+	client.Close()
+	select {
+	case <-cache.stop:
+		t.Fatal("the passed cache was closed")
+	default:
+	}
+}
+
+func TestCacheKeys(t *testing.T) {
+	server, requests := newTestServer(t)
+	client := newTestClient(t, ClientOptions{BaseURL: server.URL})
+	ctx := context.Background()
+
+	// A movie and a TV show with the same ID are cached separately
+	show, err := client.GetTVShow(ctx, "tt0000001", 1, 1)
+	require.NoError(t, err)
+	movie, err := client.GetMovie(ctx, "tt0000001")
+	require.NoError(t, err)
+	require.Equal(t, "A TV show", show.Name)
+	require.Equal(t, "A movie", movie.Name)
+	require.EqualValues(t, 2, requests.Load())
+
+	movie, err = client.GetMovie(ctx, "tt0000001")
+	require.NoError(t, err)
+	require.Equal(t, "A movie", movie.Name)
+	require.EqualValues(t, 2, requests.Load())
+}
+
+func TestDeduplication(t *testing.T) {
+	var requests atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		io.WriteString(w, `{"meta":{"id":"tt1254207","type":"movie","name":"Big Buck Bunny"}}`)
+	}))
+	defer server.Close()
+	client := newTestClient(t, ClientOptions{BaseURL: server.URL})
+
+	const calls = 50
+	errs := make(chan error, calls)
+	getMovie := func() {
+		meta, err := client.GetMovie(context.Background(), "tt1254207")
+		if err == nil && meta.Name != "Big Buck Bunny" {
+			err = fmt.Errorf("unexpected name %q", meta.Name)
+		}
+		errs <- err
+	}
+	go getMovie()
+	<-started
+	for range calls - 1 {
+		go getMovie()
+	}
+	// Give the other calls time to wait for the first request
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	for range calls {
+		require.NoError(t, <-errs)
+	}
+	require.EqualValues(t, 1, requests.Load())
+}
+
+func TestRetries(t *testing.T) {
+	// newServer creates a Cinemeta stand-in that responds with the given status codes and then with 200 OK.
+	newServer := func(t *testing.T, header http.Header, statusCodes ...int) (*httptest.Server, *atomic.Int32) {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			i := int(requests.Add(1)) - 1
+			if i < len(statusCodes) {
+				for key, values := range header {
+					w.Header()[key] = values
+				}
+				w.WriteHeader(statusCodes[i])
+				return
+			}
+			io.WriteString(w, `{"meta":{"id":"tt1254207","type":"movie","name":"Big Buck Bunny"}}`)
+		}))
+		t.Cleanup(server.Close)
+		return server, &requests
+	}
+
+	t.Run("transient errors", func(t *testing.T) {
+		server, requests := newServer(t, nil, http.StatusServiceUnavailable, http.StatusBadGateway)
+		client := newTestClient(t, ClientOptions{BaseURL: server.URL, RetryBaseDelay: time.Millisecond})
+		meta, err := client.GetMovie(context.Background(), "tt1254207")
+		require.NoError(t, err)
+		require.Equal(t, "Big Buck Bunny", meta.Name)
+		require.EqualValues(t, 3, requests.Load())
+	})
+
+	t.Run("too many transient errors", func(t *testing.T) {
+		server, requests := newServer(t, nil, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+		client := newTestClient(t, ClientOptions{BaseURL: server.URL, RetryBaseDelay: time.Millisecond})
+		_, err := client.GetMovie(context.Background(), "tt1254207")
+		require.Error(t, err)
+		require.EqualValues(t, 3, requests.Load())
+	})
+
+	t.Run("retries disabled", func(t *testing.T) {
+		server, requests := newServer(t, nil, http.StatusServiceUnavailable)
+		client := newTestClient(t, ClientOptions{BaseURL: server.URL, MaxRetries: -1})
+		_, err := client.GetMovie(context.Background(), "tt1254207")
+		require.Error(t, err)
+		require.EqualValues(t, 1, requests.Load())
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		server, requests := newServer(t, nil, http.StatusBadRequest)
+		client := newTestClient(t, ClientOptions{BaseURL: server.URL, RetryBaseDelay: time.Millisecond})
+		_, err := client.GetMovie(context.Background(), "tt1254207")
+		require.Error(t, err)
+		require.EqualValues(t, 1, requests.Load())
+	})
+
+	t.Run("Retry-After", func(t *testing.T) {
+		server, requests := newServer(t, http.Header{"Retry-After": {"1"}}, http.StatusTooManyRequests)
+		client := newTestClient(t, ClientOptions{BaseURL: server.URL, RetryBaseDelay: time.Millisecond, RetryMaxDelay: 2 * time.Second})
+		start := time.Now()
+		_, err := client.GetMovie(context.Background(), "tt1254207")
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, time.Since(start), time.Second)
+		require.EqualValues(t, 2, requests.Load())
+	})
+
+	t.Run("Retry-After longer than the max delay", func(t *testing.T) {
+		server, requests := newServer(t, http.Header{"Retry-After": {"3600"}}, http.StatusTooManyRequests)
+		client := newTestClient(t, ClientOptions{BaseURL: server.URL, RetryBaseDelay: time.Millisecond, RetryMaxDelay: time.Millisecond})
+		start := time.Now()
+		_, err := client.GetMovie(context.Background(), "tt1254207")
+		require.Error(t, err)
+		require.Less(t, time.Since(start), time.Second)
+		require.EqualValues(t, 1, requests.Load())
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, `{"meta":{"id":"tt1254207","type":"movie","name":"Big Buck Bunny"}}`)
+	}))
+	defer server.Close()
+	opts := ClientOptions{
+		BaseURL:          server.URL,
+		MaxRetries:       -1,
+		BreakerThreshold: 2,
+		BreakerCooldown:  50 * time.Millisecond,
+	}
+	client := newTestClient(t, opts)
+	ctx := context.Background()
+
+	for range 2 {
+		_, err := client.GetMovie(ctx, "tt1254207")
+		require.Error(t, err)
+		require.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	// The breaker is open now, so the client fails fast
+	_, err := client.GetMovie(ctx, "tt1254207")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.EqualValues(t, 2, requests.Load())
+
+	// After the cooldown a trial request is sent, which closes the breaker when it succeeds
+	healthy.Store(true)
+	time.Sleep(opts.BreakerCooldown)
+	meta, err := client.GetMovie(ctx, "tt1254207")
+	require.NoError(t, err)
+	require.Equal(t, "Big Buck Bunny", meta.Name)
+	_, err = client.GetTVShow(ctx, "tt1254207", 1, 1)
+	require.NotErrorIs(t, err, ErrCircuitOpen)
+	require.EqualValues(t, 4, requests.Load())
+}
+
+func TestNotFound(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	opts := ClientOptions{
+		BaseURL:          server.URL,
+		BreakerThreshold: 1,
+		NotFoundTTL:      50 * time.Millisecond,
+	}
+	client := newTestClient(t, opts)
+	ctx := context.Background()
+
+	_, err := client.GetMovie(ctx, "tt0000000")
+	require.ErrorIs(t, err, ErrNotFound)
+	// Not found IDs are cached and don't open the circuit breaker
+	_, err = client.GetMovie(ctx, "tt0000000")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.EqualValues(t, 1, requests.Load())
+	_, err = client.GetMovie(ctx, "tt0000001")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.EqualValues(t, 2, requests.Load())
+
+	time.Sleep(opts.NotFoundTTL)
+	_, err = client.GetMovie(ctx, "tt0000000")
+	require.ErrorIs(t, err, ErrNotFound)
+	require.EqualValues(t, 3, requests.Load())
+}
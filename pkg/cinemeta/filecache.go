@@ -0,0 +1,216 @@
+package cinemeta
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ Cache = (*FileCache)(nil)
+
+// fileCacheRecord is a line in the FileCache's file.
+type fileCacheRecord struct {
+	Key     string    `json:"key"`
+	Meta    Meta      `json:"meta"`
+	Created time.Time `json:"created"`
+}
+
+// minCompactionRecords is the minimum number of records in the file before the FileCache compacts it.
+const minCompactionRecords = 1000
+
+// FileCache is an implementation of the Cache interface that persists meta in a file, so it survives restarts of your addon.
+// The file is an append-only log with one JSON object per line.
+// All items are also kept in memory for fast reads.
+// When the file contains more than twice as many records as there are items, it's compacted,
+// which also removes items that are older than the TTL.
+// Call Close() when you don't need the cache anymore.
+type FileCache struct {
+	path  string
+	ttl   time.Duration
+	items map[string]CacheItem
+	file  *os.File
+	// Number of records in the file
+	records int
+	lock    *sync.Mutex
+}
+
+// NewFileCache creates a new FileCache that stores its data in the file at the given path.
+// If the file exists, the items in it are loaded, except for the ones that are older than the TTL.
+// A TTL <= 0 means that items never expire.
+func NewFileCache(path string, ttl time.Duration) (*FileCache, error) {
+	c := &FileCache{
+		path:  path,
+		ttl:   ttl,
+		items: map[string]CacheItem{},
+		lock:  &sync.Mutex{},
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	// Compact right away so expired and overwritten items don't pile up over restarts
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Set stores a meta object and the current time in the cache and appends it to the file.
+func (c *FileCache) Set(key string, meta Meta) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.file == nil {
+		return errors.New("cache is closed")
+	}
+	record := fileCacheRecord{
+		Key:     key,
+		Meta:    meta,
+		Created: time.Now(),
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal meta: %w", err)
+	}
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("couldn't write to cache file: %w", err)
+	}
+	c.items[key] = CacheItem{
+		Meta:    record.Meta,
+		Created: record.Created,
+	}
+	c.records++
+
+	if c.records >= minCompactionRecords && c.records > 2*len(c.items) {
+		return c.compact()
+	}
+	return nil
+}
+
+// Get returns a meta object and the time it was cached from the cache.
+// The boolean return value signals if the value was found in the cache.
+func (c *FileCache) Get(key string) (Meta, time.Time, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cacheItem, found := c.items[key]
+	return cacheItem.Meta, cacheItem.Created, found, nil
+}
+
+// Len returns the number of items in the cache.
+func (c *FileCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.items)
+}
+
+// Compact rewrites the file with only the current items, without the overwritten and expired ones.
+// It's called automatically, so you usually don't need to call it yourself.
+func (c *FileCache) Compact() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file == nil {
+		return errors.New("cache is closed")
+	}
+	return c.compact()
+}
+
+// Close closes the file. The cache can't be used afterwards.
+func (c *FileCache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// load reads the items from the file, if it exists.
+func (c *FileCache) load() error {
+	f, err := os.Open(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("couldn't open cache file: %w", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			// A last line without newline is the remainder of an interrupted write, so it's ignored
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("couldn't read cache file: %w", err)
+		}
+		var record fileCacheRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// Skip corrupt records instead of losing the whole cache
+			continue
+		}
+		c.items[record.Key] = CacheItem{
+			Meta:    record.Meta,
+			Created: record.Created,
+		}
+	}
+}
+
+// compact writes the non-expired items to a temporary file, replaces the cache file with it and opens it for appending.
+// The lock must be held.
+func (c *FileCache) compact() error {
+	for key, cacheItem := range c.items {
+		if c.ttl > 0 && time.Since(cacheItem.Created) > c.ttl {
+			delete(c.items, key)
+		}
+	}
+
+	tmpPath := c.path + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("couldn't create temporary cache file: %w", err)
+	}
+	writer := bufio.NewWriter(tmpFile)
+	encoder := json.NewEncoder(writer)
+	for key, cacheItem := range c.items {
+		record := fileCacheRecord{
+			Key:     key,
+			Meta:    cacheItem.Meta,
+			Created: cacheItem.Created,
+		}
+		if err := encoder.Encode(record); err != nil {
+			tmpFile.Close()
+			return fmt.Errorf("couldn't write temporary cache file: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("couldn't write temporary cache file: %w", err)
+	}
+	if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("couldn't sync temporary cache file: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("couldn't close temporary cache file: %w", err)
+	}
+
+	if c.file != nil {
+		c.file.Close()
+		c.file = nil
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		return fmt.Errorf("couldn't replace cache file: %w", err)
+	}
+	c.file, err = os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("couldn't open cache file: %w", err)
+	}
+	c.records = len(c.items)
+	return nil
+}
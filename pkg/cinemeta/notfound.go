@@ -0,0 +1,58 @@
+package cinemeta
+
+import (
+	"sync"
+	"time"
+)
+
+// notFoundCache remembers the IDs that Cinemeta doesn't know, so they're not requested again for a while.
+type notFoundCache struct {
+	ttl time.Duration
+	// Max number of IDs, so that requests for random IDs can't make it grow forever
+	size    int
+	expires map[string]time.Time
+	lock    *sync.Mutex
+}
+
+func newNotFoundCache(ttl time.Duration, size int) *notFoundCache {
+	return &notFoundCache{
+		ttl:     ttl,
+		size:    size,
+		expires: map[string]time.Time{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// add remembers the key until the TTL is over.
+func (c *notFoundCache) add(key string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.expires) >= c.size {
+		now := time.Now()
+		for k, expires := range c.expires {
+			if now.After(expires) {
+				delete(c.expires, k)
+			}
+		}
+		// If it's still full the key isn't remembered. Cinemeta is then just requested again.
+		if len(c.expires) >= c.size {
+			return
+		}
+	}
+	c.expires[key] = time.Now().Add(c.ttl)
+}
+
+// contains reports whether the key was added and its TTL isn't over yet.
+func (c *notFoundCache) contains(key string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expires, ok := c.expires[key]
+	if ok && time.Now().After(expires) {
+		delete(c.expires, key)
+		return false
+	}
+	return ok
+}
@@ -11,6 +11,11 @@ func (mt mediaType) String() string {
 	return [...]string{"movie", "TV show"}[mt-1]
 }
 
+// stremioType returns the Stremio type name like "series", which Cinemeta uses in its URLs and we use in cache keys.
+func (mt mediaType) stremioType() string {
+	return [...]string{"movie", "series"}[mt-1]
+}
+
 type cinemetaResponse struct {
 	Meta Meta `json:"meta"`
 }
@@ -38,4 +43,32 @@ type Meta struct {
 	Country     string   `json:"country,omitempty"`
 	Awards      string   `json:"awards,omitempty"`
 	Website     string   `json:"website,omitempty"`
+	Videos      []Video  `json:"videos,omitempty"` // Episodes of a TV show
+
+	// The episode that was requested with GetTVShow(), or nil if Cinemeta doesn't know it (yet).
+	// It's not part of the cached data, because the TV show is cached once for all of its episodes.
+	Episode *Video `json:"-"`
+}
+
+// Video represents an episode of a TV show.
+type Video struct {
+	ID        string `json:"id"` // E.g. "tt0944947:1:1"
+	Name      string `json:"name,omitempty"`
+	Title     string `json:"title,omitempty"` // Older Cinemeta entries use this instead of Name
+	Season    int    `json:"season"`
+	Episode   int    `json:"episode"`
+	Released  string `json:"released,omitempty"` // ISO 8601, e.g. "2011-04-17T02:00:00.000Z"
+	Thumbnail string `json:"thumbnail,omitempty"`
+	Overview  string `json:"overview,omitempty"`
+}
+
+// FindEpisode returns the episode with the given season and episode number from the Videos.
+// The boolean return value signals if the episode was found.
+func (m Meta) FindEpisode(season, episode int) (Video, bool) {
+	for _, video := range m.Videos {
+		if video.Season == season && video.Episode == episode {
+			return video, true
+		}
+	}
+	return Video{}, false
 }
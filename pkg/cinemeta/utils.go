@@ -3,21 +3,33 @@ package cinemeta
 import (
 	"context"
 	"errors"
-	"fmt"
 )
 
 var ErrNoMeta = errors.New("no meta in context")
 
+// contextKey is the key for the Meta in a context.
+// It's unexported so that no other package can overwrite or read the value without the functions of this package.
+type contextKey struct{}
+
+// NewContext returns a copy of the parent context that contains the given meta.
+func NewContext(ctx context.Context, meta Meta) context.Context {
+	return context.WithValue(ctx, contextKey{}, meta)
+}
+
+// FromContext returns the Meta object that's stored in the context.
+// The boolean return value signals if there was a meta in the context.
+func FromContext(ctx context.Context) (Meta, bool) {
+	meta, ok := ctx.Value(contextKey{}).(Meta)
+	return meta, ok
+}
+
 // GetMetaFromContext returns the Meta object that's stored in the context.
-// It returns an error if no meta was found in the context or the value found isn't of type Meta.
-// The former one is ErrNoMeta which acts as sentinel error so you can check for it.
+// It returns ErrNoMeta if no meta was found in the context, which acts as sentinel error so you can check for it.
+// It's equivalent to FromContext, which you can use if you prefer a boolean over an error.
 func GetMetaFromContext(ctx context.Context) (Meta, error) {
-	metaIface := ctx.Value("meta")
-	if metaIface == nil {
+	meta, ok := FromContext(ctx)
+	if !ok {
 		return Meta{}, ErrNoMeta
-	} else if meta, ok := metaIface.(Meta); ok {
-		return meta, nil
-	} else {
-		return Meta{}, fmt.Errorf("couldn't turn meta interface value to proper object: type is %T", metaIface)
 	}
+	return meta, nil
 }
@@ -0,0 +1,33 @@
+package stremio
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// createProfilingHandler creates a handler for the "/debug/pprof/" endpoints of net/http/pprof.
+// If a token is given, requests must contain it in an "Authorization: Bearer <token>" header.
+func createProfilingHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqToken, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		// Constant time comparison so the token can't be guessed via timing attacks
+		if !ok || subtle.ConstantTimeCompare([]byte(reqToken), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
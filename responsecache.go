@@ -0,0 +1,112 @@
+package stremio
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedResponse is a response body in the server-side response cache, together with the time it was cached.
+type CachedResponse struct {
+	Body    []byte
+	Created time.Time
+	// Cache hints that the handler set with SetCacheHints(), or nil if it didn't set any.
+	// They determine how long the response is fresh instead of the durations in the options.
+	Hints *CacheHints
+}
+
+// ResponseCache is the interface that the addon uses for caching the responses of catalog and stream handlers on the server side.
+// The addon uses an LRUResponseCache by default, but you can set your own implementation in the options, for example for a cache that's shared between multiple instances of your addon.
+// Implementations must be safe for concurrent use. They don't have to handle expiration, because the addon checks the age of cached responses itself.
+type ResponseCache interface {
+	Set(key string, response CachedResponse) error
+	Get(key string) (CachedResponse, bool, error)
+}
+
+var _ ResponseCache = (*LRUResponseCache)(nil)
+
+// lruEntry is an element of the LRUResponseCache's list.
+type lruEntry struct {
+	key      string
+	response CachedResponse
+}
+
+// LRUResponseCache is an in-memory ResponseCache with a maximum number of entries.
+// When it's full, the least recently used entry is evicted.
+type LRUResponseCache struct {
+	size    int
+	entries map[string]*list.Element
+	// Most recently used entries are at the front
+	order *list.List
+	lock  *sync.Mutex
+}
+
+// NewLRUResponseCache creates a new LRUResponseCache that holds at most size entries.
+// A size <= 0 leads to a size of 1.
+func NewLRUResponseCache(size int) *LRUResponseCache {
+	if size <= 0 {
+		size = 1
+	}
+	return &LRUResponseCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// Set stores a response in the cache and evicts the least recently used entry if the cache is full.
+func (c *LRUResponseCache) Set(key string, response CachedResponse) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*lruEntry).response = response
+		c.order.MoveToFront(elem)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, response: response})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	return nil
+}
+
+// Get returns a response from the cache.
+// The boolean return value signals if the response was found in the cache.
+func (c *LRUResponseCache) Get(key string) (CachedResponse, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return CachedResponse{}, false, nil
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).response, true, nil
+}
+
+// Len returns the number of entries in the cache.
+func (c *LRUResponseCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.order.Len()
+}
+
+// responseCacheKey creates the key for a response in the ResponseCache, like "stream/movie/tt1254207//<hash>".
+// The extra arguments are sorted by name so that their order in the URL doesn't matter.
+// The user data is hashed so that for example secrets in it don't end up in a shared cache.
+func responseCacheKey(resource, t, id string, extra url.Values, userData string) string {
+	var userDataHash string
+	if userData != "" {
+		hash := sha256.Sum256([]byte(userData))
+		userDataHash = hex.EncodeToString(hash[:])
+	}
+	return strings.Join([]string{resource, t, id, extra.Encode(), userDataHash}, "/")
+}
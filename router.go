@@ -0,0 +1,101 @@
+package stremio
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// resourceRoute is a resource handler registered in the resourceRouter.
+type resourceRoute struct {
+	handler http.Handler
+	// If true, the resource accepts "extra" arguments as additional path segment, like "/catalog/movie/foo/search=bar.json".
+	extra bool
+}
+
+// resourceRouter routes resource requests like "/stream/movie/tt1254207.json" and "/{userData}/catalog/movie/foo/skip=100.json"
+// to the resource handlers and all other requests to the next handler.
+// We can't use http.ServeMux patterns for this, because for example "/{userData}/stream/{type}/{id}" and "/catalog/{type}/{id}/{extra}"
+// would both match "/catalog/stream/foo/bar" and ServeMux panics when registering such conflicting patterns.
+// The router sets the "userData", "type", "id" and "extra" path values, so the handlers can use r.PathValue() like with ServeMux.
+// The ".json" suffix of the last segment is removed and the "extra" value is kept in its escaped form so it can be parsed as URL query.
+type resourceRouter struct {
+	routes map[string]resourceRoute
+	next   http.Handler
+}
+
+func newResourceRouter(next http.Handler) *resourceRouter {
+	return &resourceRouter{
+		routes: map[string]resourceRoute{},
+		next:   next,
+	}
+}
+
+// handle registers the handler for the resource with the given name (like "stream").
+func (rr *resourceRouter) handle(resource string, handler http.Handler, extra bool) {
+	rr.routes[resource] = resourceRoute{
+		handler: handler,
+		extra:   extra,
+	}
+}
+
+func (rr *resourceRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+
+	// Requests without user data take precedence, so that "/catalog/movie/foo/skip=100.json" isn't treated as stream request with the user data "catalog".
+	if rr.route(w, r, "", segments) {
+		return
+	}
+	if len(segments) > 1 && rr.route(w, r, segments[0], segments[1:]) {
+		return
+	}
+	rr.next.ServeHTTP(w, r)
+}
+
+// route calls the resource handler if the segments (without the user data) form a valid resource request.
+// It returns false if they don't.
+func (rr *resourceRouter) route(w http.ResponseWriter, r *http.Request, userData string, segments []string) bool {
+	if len(segments) < 3 {
+		return false
+	}
+	route, ok := rr.routes[segments[0]]
+	if !ok {
+		return false
+	}
+	if len(segments) > 4 || (len(segments) == 4 && !route.extra) {
+		return false
+	}
+	for _, segment := range segments {
+		if segment == "" {
+			return false
+		}
+	}
+	segments = slices.Clone(segments)
+	segments[len(segments)-1] = strings.TrimSuffix(segments[len(segments)-1], ".json")
+	var extra string
+	if len(segments) == 4 {
+		extra = segments[3]
+	}
+
+	// Unescape like ServeMux does for path values
+	var err error
+	if userData, err = url.PathUnescape(userData); err != nil {
+		return false
+	}
+	t, err := url.PathUnescape(segments[1])
+	if err != nil {
+		return false
+	}
+	id, err := url.PathUnescape(segments[2])
+	if err != nil {
+		return false
+	}
+
+	r.SetPathValue("userData", userData)
+	r.SetPathValue("type", t)
+	r.SetPathValue("id", id)
+	r.SetPathValue("extra", extra)
+	route.handler.ServeHTTP(w, r)
+	return true
+}
@@ -2,9 +2,10 @@ package stremio
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strconv"
 )
@@ -15,50 +16,59 @@ type SubtitleProvider interface {
 	GetSubtitles(ctx context.Context, videoID string) ([]SubtitleItem, error)
 }
 
-// SubtitleHandler is the callback for subtitle requests
-type SubtitleHandler func(ctx context.Context, videoID string, userData any) ([]SubtitleItem, error)
-
-// createSubtitleHandler creates a handler for subtitle requests
-func createSubtitleHandler(handler SubtitleHandler, cacheAge int, cachePublic bool, handleEtag bool, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Get video ID from URL
-		videoID := r.URL.Query().Get("videoId")
-		if videoID == "" {
-			http.Error(w, "Missing videoId parameter", http.StatusBadRequest)
-			return
-		}
+// SubtitleExtra contains the "extra" arguments of a subtitles request, which Stremio sends to identify the video file.
+// See https://github.com/Stremio/stremio-addon-sdk/blob/f6f1f2a8b627b9d4f2c62b003b251d98adadbebe/docs/api/requests/defineSubtitlesHandler.md
+type SubtitleExtra struct {
+	// OpenSubtitles hash of the video file
+	VideoHash string
+	// Size of the video file in bytes
+	VideoSize int64
+	// Filename of the video file
+	Filename string
+}
 
-		// Get user data from URL
-		userData, err := decodeUserData(r.URL.Query().Get("userData"), userDataType, logger, userDataIsBase64)
-		if err != nil {
-			http.Error(w, "Invalid user data", http.StatusBadRequest)
-			return
-		}
+// SubtitleHandler is the callback for subtitles requests for a specific type (like "movie").
+// The id parameter is the ID of the video, for example an IMDb ID for movies or "tt0944947:1:1" for a TV show episode.
+// The extra parameter contains info about the video file, if Stremio sent it.
+// The userData parameter depends on whether you called `RegisterUserData()` before:
+// If not, a simple string will be passed. It's empty if the user didn't provide user data.
+// If yes, a pointer to an object you registered will be passed. It's nil if the user didn't provide user data.
+type SubtitleHandler func(ctx context.Context, id string, extra SubtitleExtra, userData any) ([]SubtitleItem, error)
 
-		// Get subtitles from handler
-		subtitles, err := handler(r.Context(), videoID, userData)
-		if err != nil {
-			logger.Error("Failed to get subtitles", "error", err)
-			http.Error(w, "Failed to get subtitles", http.StatusInternalServerError)
-			return
+// parseSubtitleExtra turns the parsed extra arguments of a subtitles request into a SubtitleExtra.
+func parseSubtitleExtra(extra url.Values) (SubtitleExtra, error) {
+	subtitleExtra := SubtitleExtra{
+		VideoHash: extra.Get("videoHash"),
+		Filename:  extra.Get("filename"),
+	}
+	if videoSize := extra.Get("videoSize"); videoSize != "" {
+		var err error
+		subtitleExtra.VideoSize, err = strconv.ParseInt(videoSize, 10, 64)
+		if err != nil || subtitleExtra.VideoSize < 0 {
+			return SubtitleExtra{}, fmt.Errorf("%w: videoSize must be a non-negative integer", errInvalidExtra)
 		}
+	}
+	return subtitleExtra, nil
+}
 
-		// Set cache headers
-		if cacheAge > 0 {
-			w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(cacheAge))
+// createSubtitleHandler creates a handler for subtitles requests.
+func createSubtitleHandler(handlers map[string]SubtitleHandler, cfg resourceConfig, logger *slog.Logger, userDataType reflect.Type, userDataIsBase64 bool) http.HandlerFunc {
+	typeHandlers := make(map[string]resourceFunc, len(handlers))
+	for t, handler := range handlers {
+		typeHandlers[t] = func(ctx context.Context, id string, extra url.Values, userData any) (any, error) {
+			subtitleExtra, err := parseSubtitleExtra(extra)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, id, subtitleExtra, userData)
 		}
-
-		// Return subtitles
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(subtitles)
 	}
+	return createResourceHandler("subtitles", "subtitles", typeHandlers, cfg, logger, userDataType, userDataIsBase64)
 }
 
-// AddSubtitleHandler adds a subtitle handler to the addon
-func (a *Addon) AddSubtitleHandler(handler SubtitleHandler) {
-	a.customEndpoints = append(a.customEndpoints, customEndpoint{
-		method:  "GET",
-		path:    "/subtitles",
-		handler: createSubtitleHandler(handler, int(a.opts.CacheAgeStreams.Seconds()), a.opts.CachePublicStreams, a.opts.HandleEtagStreams, a.logger, a.userDataType, a.opts.UserDataIsBase64),
-	})
+// SetSubtitleHandlers sets the handlers for subtitles requests, one per type (like "movie").
+// Subtitles requests are only handled if this was called before running the addon.
+// Stremio only sends them if the manifest contains a "subtitles" resource.
+func (a *Addon) SetSubtitleHandlers(handlers map[string]SubtitleHandler) {
+	a.subtitleHandlers = handlers
 }
@@ -17,6 +17,7 @@ type Manifest struct {
 	Catalogs []CatalogItem `json:"catalogs"`
 
 	// Optional
+	AddonCatalogs []CatalogItem `json:"addonCatalogs,omitempty"` // Catalogs of other addons, see AddonCatalogHandler
 	IDprefixes    []string      `json:"idPrefixes,omitempty"`
 	Background    string        `json:"background,omitempty"` // URL
 	Logo          string        `json:"logo,omitempty"`       // URL
@@ -51,6 +52,14 @@ func (m Manifest) clone() Manifest {
 		}
 	}
 
+	var addonCatalogs []CatalogItem
+	if m.AddonCatalogs != nil {
+		addonCatalogs = make([]CatalogItem, len(m.AddonCatalogs))
+		for i, addonCatalog := range m.AddonCatalogs {
+			addonCatalogs[i] = addonCatalog.clone()
+		}
+	}
+
 	var idPrefixes []string
 	if m.IDprefixes != nil {
 		idPrefixes = make([]string, len(m.IDprefixes))
@@ -70,6 +79,7 @@ func (m Manifest) clone() Manifest {
 		Types:    types,
 		Catalogs: catalogs,
 
+		AddonCatalogs: addonCatalogs,
 		IDprefixes:    idPrefixes,
 		Background:    m.Background,
 		Logo:          m.Logo,
@@ -322,6 +332,14 @@ type StreamBehaviorHints struct {
 	Proxy            bool           `json:"proxy,omitempty"`            // Whether the stream should be proxied
 }
 
+// AddonDescriptor describes another addon and is meant to be used within addon catalog responses.
+// See https://github.com/Stremio/stremio-addon-sdk/blob/f6f1f2a8b627b9d4f2c62b003b251d98adadbebe/docs/api/responses/addon_catalog.md
+type AddonDescriptor struct {
+	TransportURL  string   `json:"transportUrl"`  // URL of the addon's manifest, e.g. "https://example.com/manifest.json"
+	TransportName string   `json:"transportName"` // Usually "http"
+	Manifest      Manifest `json:"manifest"`
+}
+
 // SubtitleItem represents a subtitle track for a stream
 type SubtitleItem struct {
 	ID       string `json:"id"`
@@ -46,6 +46,13 @@ func TestManifestClone(t *testing.T) {
 			},
 		},
 
+		AddonCatalogs: []CatalogItem{
+			{
+				Type: "all",
+				ID:   "some-addon-catalog",
+				Name: "Some addon catalog",
+			},
+		},
 		IDprefixes:   []string{"tt"},
 		Background:   "https://example.com/background.jpg",
 		Logo:         "https://example.com/logo.png",
@@ -97,6 +104,10 @@ func TestManifestClone(t *testing.T) {
 			name: "Catalogs.Extra.Options",
 			f:    func(m *Manifest) { m.Catalogs[0].Extra[0].Options[0] = "changed" },
 		},
+		{
+			name: "AddonCatalogs.ID",
+			f:    func(m *Manifest) { m.AddonCatalogs[0].ID = "changed" },
+		},
 		{
 			name: "IDprefixes",
 			f:    func(m *Manifest) { m.IDprefixes[0] = "changed" },
@@ -0,0 +1,86 @@
+package stremio
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// idPrefixResources are the resources whose IDs are media IDs (like "tt1254207"), which Stremio only requests for the declared ID prefixes.
+// For catalogs and addon catalogs the ID is the catalog ID that the addon declared itself.
+var idPrefixResources = []string{"meta", "stream", "subtitles"}
+
+// requestValidator validates resource requests against the manifest and options.
+type requestValidator struct {
+	resource        string
+	types           []string
+	idPrefixes      []string
+	idRegex         *regexp.Regexp
+	requireUserData bool
+}
+
+// newRequestValidator creates a validator for requests of the given resource.
+// The types and ID prefixes of the resource's ResourceItem take precedence over the ones of the manifest.
+// The ID regex can be nil.
+func newRequestValidator(resource string, manifest Manifest, idRegex *regexp.Regexp) requestValidator {
+	v := requestValidator{
+		resource:        resource,
+		types:           manifest.Types,
+		idRegex:         idRegex,
+		requireUserData: manifest.BehaviorHints.ConfigurationRequired,
+	}
+	if slices.Contains(idPrefixResources, resource) {
+		v.idPrefixes = manifest.IDprefixes
+	}
+	for _, resourceItem := range manifest.ResourceItems {
+		if resourceItem.Name != resource {
+			continue
+		}
+		if len(resourceItem.Types) > 0 {
+			v.types = resourceItem.Types
+		}
+		if len(resourceItem.IDprefixes) > 0 && slices.Contains(idPrefixResources, resource) {
+			v.idPrefixes = resourceItem.IDprefixes
+		}
+	}
+	return v
+}
+
+// validate returns the HTTP status code and an error message if the request is invalid.
+// It returns 0 and an empty string if the request is valid.
+func (v requestValidator) validate(r *http.Request) (int, string) {
+	if v.requireUserData && r.PathValue("userData") == "" && r.URL.Query().Get("userData") == "" {
+		return http.StatusBadRequest, "Configuration required"
+	}
+
+	t := r.PathValue("type")
+	if len(v.types) > 0 && !slices.Contains(v.types, t) {
+		return http.StatusBadRequest, fmt.Sprintf("Unsupported type %q", t)
+	}
+
+	id := strings.TrimSuffix(r.PathValue("id"), ".json")
+	if len(v.idPrefixes) > 0 && !slices.ContainsFunc(v.idPrefixes, func(prefix string) bool { return strings.HasPrefix(id, prefix) }) {
+		return http.StatusBadRequest, fmt.Sprintf("Unsupported ID %q", id)
+	}
+	if v.idRegex != nil && !v.idRegex.MatchString(id) {
+		return http.StatusBadRequest, fmt.Sprintf("Invalid %v ID %q", v.resource, id)
+	}
+
+	return 0, ""
+}
+
+// createValidationMiddleware creates a middleware that rejects invalid resource requests with a JSON error body.
+// It must be used within the resource router, because it relies on the path values that the router sets.
+func createValidationMiddleware(v requestValidator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status, msg := v.validate(r); status != 0 {
+				writeError(w, status, msg)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}